@@ -0,0 +1,100 @@
+package rpc
+
+import (
+    "context"
+    "errors"
+    "github.com/DGHeroin/rpc.go/common"
+    "net"
+    "testing"
+    "time"
+)
+
+func newCallPair(t *testing.T, opt *ServerOption) (*Server, *Client) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv, _ := NewServer(opt)
+    srv.Handle("game", "Echo", func(sess *common.Session, payload []byte) ([]byte, error) {
+        return payload, nil
+    })
+    srv.Handle("game", "Slow", func(sess *common.Session, payload []byte) ([]byte, error) {
+        time.Sleep(200 * time.Millisecond)
+        return payload, nil
+    })
+    srv.Handle("game", "Fail", func(sess *common.Session, payload []byte) ([]byte, error) {
+        return nil, errors.New(string(payload))
+    })
+    go func() { _ = srv.Serve(ln) }()
+    t.Cleanup(func() { _ = srv.Close() })
+
+    conn, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    cli, _ := NewClient(nil)
+    go func() { _ = cli.Serve(conn) }()
+    return srv, cli
+}
+
+func TestCallReplyStatus(t *testing.T) {
+    _, cli := newCallPair(t, nil)
+    ctx := context.Background()
+    if reply, err := cli.Call(ctx, "game", "Echo", []byte("hello")); err != nil || string(reply) != "hello" {
+        t.Fatalf("Echo = %q, %v", reply, err)
+    }
+    // 空的返回值也是成功
+    if reply, err := cli.Call(ctx, "game", "Echo", nil); err != nil || len(reply) != 0 {
+        t.Fatalf("empty Echo = %q, %v", reply, err)
+    }
+    // 错误信息为空时仍然是错误
+    for _, msg := range []string{"denied", ""} {
+        _, err := cli.Call(ctx, "game", "Fail", []byte(msg))
+        if e, ok := err.(common.ServiceError); !ok || e.Error() != msg {
+            t.Fatalf("Fail(%q) err = %#v", msg, err)
+        }
+    }
+    if _, err := cli.Call(ctx, "game", "Missing", nil); err == nil || err.Error() != common.ErrorServiceNotFound.Error() {
+        t.Fatalf("Missing err = %v", err)
+    }
+}
+
+// 慢的处理函数不阻塞同一链接上的其他调用和 keepalive
+func TestSlowHandlerDoesNotBlockConnection(t *testing.T) {
+    _, cli := newCallPair(t, &ServerOption{PingInterval: 20 * time.Millisecond, MaxMissedPings: 2})
+    ctx := context.Background()
+    slow := make(chan error, 1)
+    go func() {
+        _, err := cli.Call(ctx, "game", "Slow", nil)
+        slow <- err
+    }()
+    time.Sleep(20 * time.Millisecond)
+    start := time.Now()
+    if _, err := cli.Call(ctx, "game", "Echo", []byte("x")); err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+        t.Fatalf("Echo waited %v behind Slow", elapsed)
+    }
+    if err := <-slow; err != nil {
+        t.Fatalf("Slow err = %v", err)
+    }
+}
+
+// 客户端关闭时, 进行中的调用回复后服务器才确认关闭
+func TestCloseWaitsForCalls(t *testing.T) {
+    _, cli := newCallPair(t, nil)
+    slow := make(chan error, 1)
+    go func() {
+        reply, err := cli.Call(context.Background(), "game", "Slow", []byte("done"))
+        if err == nil && string(reply) != "done" {
+            err = errors.New("unexpected reply " + string(reply))
+        }
+        slow <- err
+    }()
+    time.Sleep(20 * time.Millisecond)
+    cli.Close()
+    if err := <-slow; err != nil {
+        t.Fatalf("Slow err = %v", err)
+    }
+}
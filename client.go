@@ -2,7 +2,9 @@ package rpc
 
 import (
     "bufio"
+    "context"
     "github.com/DGHeroin/rpc.go/common"
+    "log"
     "net"
     "sync"
     "time"
@@ -19,10 +21,41 @@ type (
         lastFlushSend   time.Time
         openOnce        *sync.Once
         sendCh          chan []byte
+        doneCh          chan struct{}
+        closeOnce       sync.Once
+        closeCode       uint32
+        closeReason     string
+        closeMutex      sync.Mutex
+        localClose      *closeInfo // 本端发起的关闭, 等待确认
+        peerClose       *closeInfo // 服务器发起的关闭, 确认写出后关闭
+        keepAlive       common.KeepAliveStats
+        clockSync       *common.ClockSync
+        pingMutex       sync.Mutex
+        pingWaiters     map[int64]chan struct{} // Ping 等待的 pong, 以 ping 的发送时间区分
     }
     ClientOption struct {
-        ReadTimeout  time.Duration
-        WriteTimeout time.Duration
+        ReadTimeout    time.Duration
+        WriteTimeout   time.Duration
+        CloseTimeout   time.Duration // 等待关闭确认的时间, 默认 1 秒
+        PingInterval   time.Duration // ping 的间隔, 0 为只在链接建立时发送一次
+        MaxMissedPings int           // 连续多少个 ping 没有回复时断开, 默认 3
+        // 时钟同步: 每隔 ClockSyncInterval 连续发送 ClockSyncSamples 个 ping,
+        // 所有 pong 都参与估算, 0 为只使用链接保持的 ping
+        ClockSyncInterval time.Duration
+        ClockSyncSamples  int // 参与估算的最近样本数, 默认 8
+    }
+    closeInfo struct {
+        code   uint32
+        reason string
+    }
+    // 异步调用, 同 net/rpc.Call, 结束时被发送到 Done
+    Call struct {
+        ServicePath   string
+        ServiceMethod string
+        Payload       []byte
+        Reply         []byte
+        Error         error
+        Done          chan *Call
     }
 )
 
@@ -35,6 +68,9 @@ func NewClient(opt *ClientOption) (*Client, error) {
         requestManager: common.NewRequestManager(),
         openOnce:       &sync.Once{},
         sendCh:         make(chan []byte, 10),
+        doneCh:         make(chan struct{}),
+        clockSync:      common.NewClockSync(opt.ClockSyncSamples),
+        pingWaiters:    make(map[int64]chan struct{}),
     }
     return cli, nil
 }
@@ -49,7 +85,16 @@ func (c *Client) RemovePlugin(p interface{}) {
     c.pluginContainer.Remove(p)
 }
 func (c *Client) Serve(conn net.Conn) error {
+    c.closeMutex.Lock()
     c.conn = conn
+    c.closeMutex.Unlock()
+    select {
+    case <-c.doneCh:
+        // closed before serve
+        _ = conn.Close()
+        return common.ErrorConnectionClosed
+    default:
+    }
 
     var (
         wg sync.WaitGroup
@@ -57,44 +102,82 @@ func (c *Client) Serve(conn net.Conn) error {
     )
     r = bufio.NewReaderSize(conn, 16*1024)
     defer func() {
-        _ = c.sendClose()
-        _ = conn.Close()
         c.pluginContainer.Range(func(i interface{}) {
             if p, ok := i.(common.ClientOnClosePlugin); ok {
-                p.OnClose()
+                p.OnClose(c.closeCode, c.closeReason)
             }
         })
     }()
     // send ping
     err := c.sendKeepAlive()
     if err != nil {
+        c.shutdown(common.CloseCodeError, err.Error(), common.ErrorConnectionClosed)
         return err
     }
     wg.Add(1)
     go func() {
-        defer wg.Done()
+        defer func() {
+            wg.Done()
+            c.shutdown(common.CloseCodeError, "write loop exit", common.ErrorConnectionClosed)
+        }()
         for {
             select {
+            case <-c.doneCh:
+                return
             case data := <-c.sendCh:
-                _, err = conn.Write(data)
-                if err != nil {
+                if err := c.setWriteTimeout(); err != nil {
                     return
                 }
+                if _, err := conn.Write(data); err != nil {
+                    return
+                }
+                if common.IsCloseAckFrame(data) {
+                    c.closeMutex.Lock()
+                    info := c.peerClose
+                    c.closeMutex.Unlock()
+                    if info != nil {
+                        c.shutdown(info.code, info.reason, common.ErrorClosedByPeer)
+                        return
+                    }
+                }
             }
         }
     }()
+    if c.option.PingInterval > 0 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            keepAliveLoop(c.option.PingInterval, c.option.MaxMissedPings, &c.keepAlive, c.doneCh,
+                func() error {
+                    return c.postMessage(common.NewPingMessage(c.sendCh, c.doneCh, c.keepAlive.Track()))
+                },
+                func() {
+                    c.shutdown(common.CloseCodeError, "keepalive timeout", common.ErrorConnectionClosed)
+                })
+        }()
+    }
+    if c.option.ClockSyncInterval > 0 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            c.clockSyncLoop()
+        }()
+    }
     wg.Add(1)
     go func() {
-        defer wg.Done()
-        for {
-            if err := c.setReadTimeout(); err != nil {
-                return
+        var err error
+        defer func() {
+            wg.Done()
+            if err != nil {
+                c.shutdown(common.CloseCodeError, err.Error(), common.ErrorConnectionClosed)
             }
-            var msg = common.NewMessage(c.sendCh)
-            if err := msg.Decode(r); err != nil {
+        }()
+        for {
+            if err = c.setReadTimeout(); err != nil {
                 return
             }
-            if err != nil {
+            var msg = c.newMessage()
+            if err = msg.Decode(r); err != nil {
                 return
             }
             c.openOnce.Do(func() {
@@ -112,9 +195,42 @@ func (c *Client) Serve(conn net.Conn) error {
                         p.OnMessage(msg)
                     }
                 })
-            case common.MessageTypeResponse:
+            case common.MessageTypeResponse, common.MessageTypeError:
                 // on reply
                 c.requestManager.OnReply(msg)
+            case common.MessageTypeKeep:
+                var (
+                    k   *common.KeepAlive
+                    rtt time.Duration
+                )
+                if k, rtt, err = handleKeepAlive(msg, &c.keepAlive); err != nil {
+                    return
+                }
+                if k != nil {
+                    c.clockSync.OnPong(k, rtt)
+                    c.onPong(k)
+                }
+            case common.MessageTypeClose:
+                // closed by server, ack after pending replies
+                code, reason := common.DecodeClosePayload(msg.Payload)
+                c.closeMutex.Lock()
+                c.peerClose = &closeInfo{code: code, reason: reason}
+                c.closeMutex.Unlock()
+                ack := c.newMessage()
+                ack.Type = common.MessageTypeCloseAck
+                if err = c.postMessage(ack); err != nil {
+                    return
+                }
+            case common.MessageTypeCloseAck:
+                // server acked our close
+                c.closeMutex.Lock()
+                info := c.localClose
+                c.closeMutex.Unlock()
+                if info == nil {
+                    info = &closeInfo{code: common.CloseCodeNormal}
+                }
+                c.shutdown(info.code, info.reason, common.ErrorConnectionClosed)
+                return
             }
         }
     }()
@@ -123,19 +239,152 @@ func (c *Client) Serve(conn net.Conn) error {
 }
 
 func (c *Client) Close() {
-    _ = c.conn.Close()
+    _ = c.CloseWithCode(common.CloseCodeNormal, "")
 }
 
-func (c *Client) Request(data []byte, cb func(*common.Message)) (err error) {
+// 发送关闭消息, 收到服务器确认(之前请求的回复都已收到)后关闭链接, 超时则直接关闭
+func (c *Client) CloseWithCode(code uint32, reason string) error {
+    c.closeMutex.Lock()
+    if c.localClose == nil {
+        c.localClose = &closeInfo{code: code, reason: reason}
+    }
+    c.closeMutex.Unlock()
+    msg := c.newMessage()
+    msg.Type = common.MessageTypeClose
+    msg.Payload = common.EncodeClosePayload(code, reason)
+    // 服务器不读取数据时写出会阻塞, 发送关闭消息同样受超时限制
+    timer := time.NewTimer(c.closeTimeout())
+    defer timer.Stop()
+    select {
+    case c.sendCh <- msg.Encode():
+    case <-c.doneCh:
+        return common.ErrorConnectionClosed
+    case <-timer.C:
+        c.shutdown(code, reason, common.ErrorConnectionClosed)
+        return nil
+    }
+    select {
+    case <-c.doneCh:
+    case <-timer.C:
+        c.shutdown(code, reason, common.ErrorConnectionClosed)
+    }
+    return nil
+}
+
+// 关闭链接, 只有第一次调用的 code 和 reason 会被记录, 未回复的请求以 err 结束
+func (c *Client) shutdown(code uint32, reason string, err error) {
+    c.closeOnce.Do(func() {
+        c.closeCode = code
+        c.closeReason = reason
+        close(c.doneCh)
+        c.closeMutex.Lock()
+        conn := c.conn
+        c.closeMutex.Unlock()
+        if conn != nil {
+            _ = conn.Close()
+        }
+        c.requestManager.CloseAll(err)
+    })
+}
+
+// 链接关闭的原因, 在链接关闭之后有效
+func (c *Client) CloseReason() (uint32, string) {
+    select {
+    case <-c.doneCh:
+        return c.closeCode, c.closeReason
+    default:
+        return common.CloseCodeNormal, ""
+    }
+}
+
+func (c *Client) newMessage() *common.Message {
     msg := common.NewMessage(c.sendCh)
+    msg.Done = c.doneCh
+    return msg
+}
+
+func (c *Client) Request(data []byte, cb func(*common.Message)) (err error) {
+    msg := c.newMessage()
     msg.Type = common.MessageTypeRequest
     msg.RequestId = c.requestManager.NextRequestId(cb)
     msg.Payload = data
-    return c.postMessage(msg)
+    if err = c.postMessage(msg); err != nil {
+        c.requestManager.Remove(msg.RequestId)
+    }
+    return err
+}
+
+// 调用服务端 Server.Handle 注册的处理函数, ctx 结束时放弃等待回复
+func (c *Client) Call(ctx context.Context, servicePath string, serviceMethod string, payload []byte) ([]byte, error) {
+    call := <-c.Go(ctx, servicePath, serviceMethod, payload, make(chan *Call, 1)).Done
+    return call.Reply, call.Error
+}
+
+// done 为 nil 时新建, 否则必须带缓冲, 同 net/rpc.Client.Go
+// ctx 可以取消时才启动一个等待 ctx 的 goroutine
+func (c *Client) Go(ctx context.Context, servicePath string, serviceMethod string, payload []byte, done chan *Call) *Call {
+    if done == nil {
+        done = make(chan *Call, 10)
+    } else if cap(done) == 0 {
+        log.Panic("rpc: done channel is unbuffered")
+    }
+    call := &Call{
+        ServicePath:   servicePath,
+        ServiceMethod: serviceMethod,
+        Payload:       payload,
+        Done:          done,
+    }
+    var finished chan struct{}
+    if ctx.Done() != nil {
+        finished = make(chan struct{})
+    }
+    msg := c.newMessage()
+    msg.Type = common.MessageTypeCall
+    msg.RequestId = c.requestManager.NextRequestId(func(reply *common.Message) {
+        if reply.Err != nil {
+            call.Error = reply.Err
+        } else {
+            call.Reply, call.Error = common.DecodeCallReply(reply.Payload)
+        }
+        if finished != nil {
+            close(finished)
+        }
+        call.done()
+    })
+    msg.Payload = common.EncodeCall(servicePath, serviceMethod, payload)
+    id := msg.RequestId
+    if err := c.postMessage(msg); err != nil {
+        if c.requestManager.Remove(id) {
+            call.Error = err
+            call.done()
+        }
+        return call
+    }
+    if finished != nil {
+        go func() {
+            select {
+            case <-finished:
+            case <-ctx.Done():
+                if c.requestManager.Remove(id) {
+                    call.Error = ctx.Err()
+                    call.done()
+                }
+            }
+        }()
+    }
+    return call
+}
+
+func (call *Call) done() {
+    select {
+    case call.Done <- call:
+    default:
+        log.Println("rpc: discarding Call reply due to insufficient Done chan capacity")
+    }
 }
 
 func (c *Client) Push(data []byte) (err error) {
-    msg := common.NewMessage(c.sendCh)
+    msg := c.newMessage()
     msg.Type = common.MessageTypeOneWay
     msg.RequestId = 0
     msg.Payload = data
@@ -143,14 +392,91 @@ func (c *Client) Push(data []byte) (err error) {
 }
 
 func (c *Client) sendKeepAlive() error {
-    msg := common.NewMessage(c.sendCh)
-    msg.Type = common.MessageTypeKeep
-    return c.postMessage(msg)
+    c.keepAlive.OnPing()
+    return c.postMessage(common.NewPingMessage(c.sendCh, c.doneCh, c.keepAlive.Track()))
 }
-func (c *Client) sendClose() error {
-    msg := common.NewMessage(c.sendCh)
-    msg.Type = common.MessageTypeClose
-    return c.postMessage(msg)
+
+// 发送一个 ping 并等待 pong, 返回这次的往返时间, 不计入丢失的 ping
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+    start := time.Now()
+    sendTime := c.keepAlive.Track()
+    ch := make(chan struct{})
+    c.pingMutex.Lock()
+    c.pingWaiters[sendTime] = ch
+    c.pingMutex.Unlock()
+    defer func() {
+        c.pingMutex.Lock()
+        delete(c.pingWaiters, sendTime)
+        c.pingMutex.Unlock()
+    }()
+    msg := common.NewPingMessage(c.sendCh, c.doneCh, sendTime)
+    if err := c.postMessage(msg); err != nil {
+        return 0, err
+    }
+    select {
+    case <-ch:
+        return time.Since(start), nil
+    case <-c.doneCh:
+        return 0, common.ErrorConnectionClosed
+    case <-ctx.Done():
+        return 0, ctx.Err()
+    }
+}
+
+func (c *Client) onPong(k *common.KeepAlive) {
+    c.pingMutex.Lock()
+    ch, ok := c.pingWaiters[k.SendTime]
+    delete(c.pingWaiters, k.SendTime)
+    c.pingMutex.Unlock()
+    if ok {
+        close(ch)
+    }
+}
+
+// ping 测得的平滑延迟
+func (c *Client) RTT() time.Duration {
+    return c.keepAlive.RTT()
+}
+
+func (c *Client) Jitter() time.Duration {
+    return c.keepAlive.Jitter()
+}
+
+// 估算的服务器当前时间, 还没有样本时为本地时间
+func (c *Client) ServerTime() time.Time {
+    return c.clockSync.PeerTime()
+}
+
+// 服务器时间减去本地时间
+func (c *Client) ClockOffset() time.Duration {
+    return c.clockSync.Offset()
+}
+
+// ClockOffset 的最大误差
+func (c *Client) ClockError() time.Duration {
+    return c.clockSync.Error()
+}
+
+// 连续发送一组 ping 采样, 不计入丢失的 ping
+func (c *Client) clockSyncLoop() {
+    samples := c.option.ClockSyncSamples
+    if samples <= 0 {
+        samples = common.DefaultClockSyncSamples
+    }
+    ticker := time.NewTicker(c.option.ClockSyncInterval)
+    defer ticker.Stop()
+    for {
+        for i := 0; i < samples; i++ {
+            if err := c.postMessage(common.NewPingMessage(c.sendCh, c.doneCh, c.keepAlive.Track())); err != nil {
+                return
+            }
+        }
+        select {
+        case <-c.doneCh:
+            return
+        case <-ticker.C:
+        }
+    }
 }
 
 func (c *Client) Reconnect(second time.Duration) {
@@ -159,11 +485,13 @@ func (c *Client) Reconnect(second time.Duration) {
     })
 }
 func (c *Client) postMessage(msg *common.Message) error {
-    if err := c.setWriteTimeout(); err != nil {
-        return err
+    return msg.Emit()
+}
+func (c *Client) closeTimeout() time.Duration {
+    if c.option.CloseTimeout == 0 {
+        return time.Second
     }
-    msg.Emit()
-    return nil
+    return c.option.CloseTimeout
 }
 func (c *Client) setReadTimeout() error {
     if c.option.ReadTimeout == 0 {
@@ -0,0 +1,236 @@
+package client
+
+import (
+    "context"
+    "sync"
+    "time"
+)
+
+type (
+    CircuitState int
+    // 每个服务器地址一个熔断器, 阈值为 0 时不按该条件打开
+    BreakerOption struct {
+        FailureThreshold int           // 连续失败次数达到后打开
+        ErrorRate        float64       // 窗口内错误率达到后打开, 如 0.5
+        MinRequests      int           // 窗口内请求数达到后才计算错误率
+        Window           time.Duration // 统计错误率的窗口
+        CoolDown         time.Duration // 打开后经过该时间进入半开, 放行一个探测请求
+    }
+    // xClient 中实现该接口的插件在熔断状态变化时被调用
+    // 在单独的 goroutine 中按变化的顺序调用, 不持有 xClient 的锁, 可以在其中发起调用
+    CircuitBreakerPlugin interface {
+        OnCircuitStateChange(server string, from, to CircuitState)
+    }
+    circuitBreaker struct {
+        state       CircuitState
+        openedAt    time.Time
+        probing     bool // 半开时探测请求已发出
+        consecutive int
+        requests    int
+        failures    int
+        windowStart time.Time
+    }
+    circuitEvent struct {
+        server   string
+        from, to CircuitState
+    }
+    // breakerSelector skips servers whose circuit breaker is open.
+    breakerSelector struct {
+        option    BreakerOption
+        onChange  func(server string, from, to CircuitState)
+        mutex     sync.RWMutex
+        servers   KVPairs
+        breakers  map[string]*circuitBreaker
+        recheckAt time.Time // 最早进入半开的时间
+        inner     Selector  // 只包含可用的服务器
+    }
+)
+
+const (
+    CircuitClosed CircuitState = iota
+    CircuitOpen
+    CircuitHalfOpen
+)
+
+var DefaultBreakerOption = BreakerOption{
+    FailureThreshold: 5,
+    ErrorRate:        0.5,
+    MinRequests:      20,
+    Window:           10 * time.Second,
+    CoolDown:         5 * time.Second,
+}
+
+func (s CircuitState) String() string {
+    switch s {
+    case CircuitClosed:
+        return "closed"
+    case CircuitOpen:
+        return "open"
+    case CircuitHalfOpen:
+        return "half-open"
+    default:
+        return "unknown"
+    }
+}
+
+func newBreakerSelector(inner Selector, option BreakerOption, onChange func(server string, from, to CircuitState), servers KVPairs) Selector {
+    s := &breakerSelector{
+        option:   option,
+        onChange: onChange,
+        breakers: make(map[string]*circuitBreaker),
+        inner:    inner,
+    }
+    s.UpdateServer(servers)
+    return s
+}
+
+func (s *breakerSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+    s.mutex.RLock()
+    expired := !s.recheckAt.IsZero() && time.Now().After(s.recheckAt)
+    s.mutex.RUnlock()
+    if expired {
+        s.mutex.Lock()
+        events := s.refresh()
+        s.mutex.Unlock()
+        s.notify(events)
+    }
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+    return s.inner.Select(ctx, servicePath, serviceMethod, args)
+}
+
+// 保留仍存在的服务器的熔断状态
+func (s *breakerSelector) UpdateServer(servers KVPairs) {
+    s.mutex.Lock()
+    s.servers = servers
+    breakers := make(map[string]*circuitBreaker, len(servers))
+    for _, kv := range servers {
+        if b, ok := s.breakers[kv.Key]; ok {
+            breakers[kv.Key] = b
+        } else {
+            breakers[kv.Key] = &circuitBreaker{}
+        }
+    }
+    s.breakers = breakers
+    events := s.refresh()
+    s.mutex.Unlock()
+    s.notify(events)
+}
+
+// 冷却结束的熔断器进入半开, 并更新 inner 的服务器列表, 调用时需持有写锁
+func (s *breakerSelector) refresh() []circuitEvent {
+    var events []circuitEvent
+    now := time.Now()
+    s.recheckAt = time.Time{}
+    available := make(KVPairs, 0, len(s.servers))
+    for _, kv := range s.servers {
+        b := s.breakers[kv.Key]
+        if b.state == CircuitOpen {
+            until := b.openedAt.Add(s.option.CoolDown)
+            if now.Before(until) {
+                if s.recheckAt.IsZero() || until.Before(s.recheckAt) {
+                    s.recheckAt = until
+                }
+                continue
+            }
+            b.state, b.probing = CircuitHalfOpen, false
+            events = append(events, circuitEvent{server: kv.Key, from: CircuitOpen, to: CircuitHalfOpen})
+        }
+        if b.state == CircuitHalfOpen && b.probing {
+            continue
+        }
+        available = append(available, kv)
+    }
+    s.inner.UpdateServer(available)
+    return events
+}
+
+func (s *breakerSelector) notify(events []circuitEvent) {
+    if s.onChange == nil {
+        return
+    }
+    for _, e := range events {
+        s.onChange(e.server, e.from, e.to)
+    }
+}
+
+// 半开时只放行一个探测请求, 结果返回前不再选择该服务器
+func (s *breakerSelector) OnCallStart(server string) {
+    if observer, ok := s.inner.(CallObserver); ok {
+        observer.OnCallStart(server)
+    }
+    s.mutex.Lock()
+    var events []circuitEvent
+    b, ok := s.breakers[server]
+    if ok && b.state == CircuitHalfOpen && !b.probing {
+        b.probing = true
+        events = s.refresh()
+    }
+    s.mutex.Unlock()
+    s.notify(events)
+}
+
+func (s *breakerSelector) OnCallDone(server string, latency time.Duration, err error) {
+    if observer, ok := s.inner.(CallObserver); ok {
+        observer.OnCallDone(server, latency, err)
+    }
+    s.mutex.Lock()
+    b, ok := s.breakers[server]
+    if !ok {
+        s.mutex.Unlock()
+        return
+    }
+    from := b.state
+    b.onResult(s.option, isServerFailure(err))
+    var events []circuitEvent
+    if b.state != from {
+        events = append(events, circuitEvent{server: server, from: from, to: b.state})
+    }
+    if b.state != from || from == CircuitHalfOpen {
+        events = append(events, s.refresh()...)
+    }
+    s.mutex.Unlock()
+    s.notify(events)
+}
+
+func (b *circuitBreaker) onResult(option BreakerOption, failed bool) {
+    now := time.Now()
+    switch b.state {
+    case CircuitHalfOpen:
+        if failed {
+            b.open(now)
+        } else {
+            b.reset(now)
+        }
+        return
+    case CircuitOpen:
+        // 打开前发出的请求, 不影响状态
+        return
+    }
+    if option.Window > 0 && now.Sub(b.windowStart) > option.Window {
+        b.requests, b.failures, b.windowStart = 0, 0, now
+    }
+    b.requests++
+    if !failed {
+        b.consecutive = 0
+        return
+    }
+    b.failures++
+    b.consecutive++
+    if option.FailureThreshold > 0 && b.consecutive >= option.FailureThreshold {
+        b.open(now)
+        return
+    }
+    if option.ErrorRate > 0 && b.requests >= option.MinRequests &&
+        float64(b.failures)/float64(b.requests) >= option.ErrorRate {
+        b.open(now)
+    }
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+    b.state, b.openedAt, b.probing = CircuitOpen, now, false
+}
+
+func (b *circuitBreaker) reset(now time.Time) {
+    *b = circuitBreaker{windowStart: now}
+}
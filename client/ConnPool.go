@@ -0,0 +1,261 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "github.com/DGHeroin/rpc.go"
+    "github.com/DGHeroin/rpc.go/common"
+    "golang.org/x/sync/singleflight"
+    "log"
+    "net"
+    "sync"
+    "time"
+)
+
+type (
+    // 同一地址的多个链接, 按需建立, 调用分配到进行中请求最少的链接
+    // 断开的链接从池中移除, 不影响其他链接上进行中的调用, 之后按需重新建立
+    connPool struct {
+        size    int
+        option  rpc.ClientOption
+        dial    func(ctx context.Context) (net.Conn, error)
+        mutex   sync.Mutex
+        members []*poolMember
+        dialing int           // 正在建立的链接数
+        dialCh  chan struct{} // 有链接建立完成时关闭
+        closed  bool
+        sfGroup singleflight.Group
+    }
+    poolMember struct {
+        cli      *rpc.Client
+        active   int // 进行中的调用数, 由 connPool.mutex 保护
+        watching int // 进行中的 WatchHealth, 不计入 active, 但有时不回收
+        lastUsed time.Time
+    }
+)
+
+func newConnPool(size int, option rpc.ClientOption, dial func(ctx context.Context) (net.Conn, error)) *connPool {
+    if size <= 0 {
+        size = 1
+    }
+    return &connPool{
+        size:   size,
+        option: option,
+        dial:   dial,
+    }
+}
+
+// 有空闲链接时使用空闲链接, 都在使用中且未满时建立新链接, 否则使用进行中调用最少的链接
+// ctx 同时限制建立链接和等待其他调用建立链接的时间
+func (p *connPool) get(ctx context.Context) (*poolMember, error) {
+    for {
+        p.mutex.Lock()
+        if p.closed {
+            p.mutex.Unlock()
+            return nil, common.ErrorConnectionClosed
+        }
+        var best *poolMember
+        for _, m := range p.members {
+            if best == nil || m.active < best.active {
+                best = m
+            }
+        }
+        if best != nil && best.active > 0 && len(p.members) < p.size {
+            if len(p.members)+p.dialing < p.size {
+                p.dialing++
+                if p.dialCh == nil {
+                    p.dialCh = make(chan struct{})
+                }
+                p.mutex.Unlock()
+                m, err := p.connect(ctx, 1)
+                p.mutex.Lock()
+                p.dialing--
+                close(p.dialCh)
+                p.dialCh = nil
+                if p.dialing > 0 {
+                    p.dialCh = make(chan struct{})
+                }
+                if err != nil {
+                    best.active++
+                    m = best
+                }
+                p.mutex.Unlock()
+                return m, nil
+            }
+            // 等待正在建立的链接, 避免都堆积到已有的链接上
+            dialCh := p.dialCh
+            p.mutex.Unlock()
+            select {
+            case <-dialCh:
+            case <-ctx.Done():
+                return nil, ctx.Err()
+            }
+            continue
+        }
+        if best != nil {
+            best.active++
+            p.mutex.Unlock()
+            return best, nil
+        }
+        p.mutex.Unlock()
+        // 没有链接时只建立一个, 其他调用等待后重新选择
+        // 建立链接的调用取消或超时时, 等待的调用用自己的 ctx 重新建立
+        ch := p.sfGroup.DoChan("", func() (interface{}, error) {
+            return p.connect(ctx, 0)
+        })
+        select {
+        case r := <-ch:
+            if r.Err == nil || ctx.Err() == nil && isContextError(r.Err) {
+                continue
+            }
+            return nil, r.Err
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+}
+
+func isContextError(err error) bool {
+    return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (p *connPool) put(m *poolMember) {
+    p.mutex.Lock()
+    if m.active > 0 {
+        m.active--
+    }
+    m.lastUsed = time.Now()
+    p.mutex.Unlock()
+}
+
+// 建立链接并加入池中, 链接断开后移除
+func (p *connPool) connect(ctx context.Context, active int) (*poolMember, error) {
+    conn, err := p.dial(ctx)
+    if err != nil {
+        return nil, err
+    }
+    opt := p.option
+    cli, err := rpc.NewClient(&opt)
+    if err != nil {
+        _ = conn.Close()
+        return nil, err
+    }
+    m := &poolMember{cli: cli, active: active, lastUsed: time.Now()}
+    p.mutex.Lock()
+    if p.closed {
+        p.mutex.Unlock()
+        _ = conn.Close()
+        return nil, common.ErrorConnectionClosed
+    }
+    p.members = append(p.members, m)
+    p.mutex.Unlock()
+    go func() {
+        if err := cli.Serve(conn); err != nil {
+            log.Println(err)
+        }
+        p.remove(m)
+    }()
+    return m, nil
+}
+
+func (p *connPool) remove(m *poolMember) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    for i, v := range p.members {
+        if v == m {
+            p.members = append(p.members[:i], p.members[i+1:]...)
+            return
+        }
+    }
+}
+
+// 关闭空闲超过 idleTimeout 的链接
+func (p *connPool) reap(idleTimeout time.Duration) {
+    now := time.Now()
+    var idle []*poolMember
+    p.mutex.Lock()
+    members := p.members[:0]
+    for _, m := range p.members {
+        if m.active == 0 && m.watching == 0 && now.Sub(m.lastUsed) > idleTimeout {
+            idle = append(idle, m)
+            continue
+        }
+        members = append(members, m)
+    }
+    p.members = members
+    p.mutex.Unlock()
+    for _, m := range idle {
+        m.cli.Close()
+    }
+}
+
+func (p *connPool) Call(ctx context.Context, servicePath string, serviceMethod string, payload []byte) ([]byte, error) {
+    m, err := p.get(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer p.put(m)
+    return m.cli.Call(ctx, servicePath, serviceMethod, payload)
+}
+
+func (p *connPool) Ping(ctx context.Context) (time.Duration, error) {
+    m, err := p.get(ctx)
+    if err != nil {
+        return 0, err
+    }
+    defer p.put(m)
+    return m.cli.Ping(ctx)
+}
+
+// 等待时间很长, 不计入进行中的调用, 避免调用都去建立新链接; 等待期间链接不被回收
+func (p *connPool) WatchHealth(ctx context.Context, servicePath string, known rpc.HealthStatus) (rpc.HealthStatus, error) {
+    m, err := p.get(ctx)
+    if err != nil {
+        return "", err
+    }
+    p.mutex.Lock()
+    m.watching++
+    p.mutex.Unlock()
+    p.put(m)
+    defer func() {
+        p.mutex.Lock()
+        m.watching--
+        m.lastUsed = time.Now()
+        p.mutex.Unlock()
+    }()
+    return m.cli.WatchHealth(ctx, servicePath, known)
+}
+
+func (p *connPool) Request(data []byte, cb func(*common.Message)) error {
+    m, err := p.get(context.Background())
+    if err != nil {
+        return err
+    }
+    if err = m.cli.Request(data, func(msg *common.Message) {
+        p.put(m)
+        cb(msg)
+    }); err != nil {
+        p.put(m)
+    }
+    return err
+}
+
+func (p *connPool) Push(data []byte) error {
+    m, err := p.get(context.Background())
+    if err != nil {
+        return err
+    }
+    defer p.put(m)
+    return m.cli.Push(data)
+}
+
+func (p *connPool) Close() {
+    p.mutex.Lock()
+    p.closed = true
+    members := p.members
+    p.members = nil
+    p.mutex.Unlock()
+    for _, m := range members {
+        m.cli.Close()
+    }
+}
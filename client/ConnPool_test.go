@@ -0,0 +1,201 @@
+package client
+
+import (
+    "context"
+    "github.com/DGHeroin/rpc.go"
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// 记录建立的链接
+type poolDialer struct {
+    addr  string
+    mutex sync.Mutex
+    conns []net.Conn
+}
+
+func (d *poolDialer) dial(ctx context.Context) (net.Conn, error) {
+    var dialer net.Dialer
+    conn, err := dialer.DialContext(ctx, "tcp", d.addr)
+    if err != nil {
+        return nil, err
+    }
+    d.mutex.Lock()
+    d.conns = append(d.conns, conn)
+    d.mutex.Unlock()
+    return conn, nil
+}
+
+func (d *poolDialer) count() int {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    return len(d.conns)
+}
+
+func newTestPool(t *testing.T, size int, delay time.Duration) (*connPool, *poolDialer) {
+    d := &poolDialer{addr: startServer(t, "up", delay, nil)}
+    p := newConnPool(size, rpc.ClientOption{}, d.dial)
+    t.Cleanup(p.Close)
+    return p, d
+}
+
+func poolLen(p *connPool) int {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    return len(p.members)
+}
+
+// 调用时才建立链接, 空闲时复用同一个链接
+func TestConnPoolLazyDial(t *testing.T) {
+    p, d := newTestPool(t, 4, 0)
+    if d.count() != 0 {
+        t.Fatalf("dialed %d before the first call", d.count())
+    }
+    for i := 0; i < 3; i++ {
+        if _, err := p.Call(context.Background(), "game", "Name", nil); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if d.count() != 1 {
+        t.Fatalf("dialed %d for sequential calls", d.count())
+    }
+}
+
+// 并发调用时增长到 PoolSize, 不超过
+func TestConnPoolGrowsToSize(t *testing.T) {
+    p, d := newTestPool(t, 3, 100*time.Millisecond)
+    var wg sync.WaitGroup
+    var failed int32
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if _, err := p.Call(context.Background(), "game", "Name", nil); err != nil {
+                atomic.AddInt32(&failed, 1)
+            }
+        }()
+        time.Sleep(5 * time.Millisecond)
+    }
+    wg.Wait()
+    if failed != 0 || d.count() != 3 || poolLen(p) != 3 {
+        t.Fatalf("failed = %d, dialed = %d, members = %d", failed, d.count(), poolLen(p))
+    }
+}
+
+// 空闲的链接被回收, 进行中的调用和 WatchHealth 所在的链接保留
+func TestConnPoolReap(t *testing.T) {
+    p, d := newTestPool(t, 2, 0)
+    if _, err := p.Call(context.Background(), "game", "Name", nil); err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(20 * time.Millisecond)
+    p.reap(10 * time.Millisecond)
+    if poolLen(p) != 0 {
+        t.Fatalf("members = %d after reap", poolLen(p))
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    watchErr := make(chan error, 1)
+    go func() {
+        _, err := p.WatchHealth(ctx, "game", rpc.HealthServing)
+        watchErr <- err
+    }()
+    time.Sleep(50 * time.Millisecond)
+    p.reap(10 * time.Millisecond)
+    if poolLen(p) != 1 {
+        t.Fatalf("members = %d, watching member reaped", poolLen(p))
+    }
+    cancel()
+    if err := <-watchErr; err != context.Canceled {
+        t.Fatalf("WatchHealth err = %v", err)
+    }
+    time.Sleep(20 * time.Millisecond)
+    p.reap(10 * time.Millisecond)
+    if poolLen(p) != 0 || d.count() != 2 {
+        t.Fatalf("members = %d, dialed = %d", poolLen(p), d.count())
+    }
+}
+
+// 断开的链接被移除, 其他链接上进行中的调用不受影响
+func TestConnPoolRemovesDeadMember(t *testing.T) {
+    p, d := newTestPool(t, 2, 200*time.Millisecond)
+    results := make(chan error, 2)
+    for i := 0; i < 2; i++ {
+        go func() {
+            _, err := p.Call(context.Background(), "game", "Name", nil)
+            results <- err
+        }()
+        time.Sleep(20 * time.Millisecond)
+    }
+    if d.count() != 2 {
+        t.Fatalf("dialed = %d", d.count())
+    }
+    d.mutex.Lock()
+    _ = d.conns[0].Close()
+    d.mutex.Unlock()
+
+    var ok, failed int
+    for i := 0; i < 2; i++ {
+        if err := <-results; err != nil {
+            failed++
+        } else {
+            ok++
+        }
+    }
+    if ok != 1 || failed != 1 {
+        t.Fatalf("ok = %d, failed = %d", ok, failed)
+    }
+    if poolLen(p) != 1 {
+        t.Fatalf("members = %d", poolLen(p))
+    }
+    if _, err := p.Call(context.Background(), "game", "Name", nil); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// 建立链接的调用取消时, 等待同一链接的调用用自己的 ctx 重新建立
+func TestConnPoolSharedDialCancel(t *testing.T) {
+    addr := startServer(t, "up", 0, nil)
+    release := make(chan struct{})
+    var dials int32
+    p := newConnPool(1, rpc.ClientOption{}, func(ctx context.Context) (net.Conn, error) {
+        if atomic.AddInt32(&dials, 1) == 1 {
+            <-ctx.Done()
+            close(release)
+            return nil, ctx.Err()
+        }
+        var dialer net.Dialer
+        return dialer.DialContext(ctx, "tcp", addr)
+    })
+    defer p.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    first := make(chan error, 1)
+    go func() {
+        _, err := p.Call(ctx, "game", "Name", nil)
+        first <- err
+    }()
+    time.Sleep(20 * time.Millisecond)
+    second := make(chan error, 1)
+    go func() {
+        _, err := p.Call(context.Background(), "game", "Name", nil)
+        second <- err
+    }()
+    time.Sleep(20 * time.Millisecond)
+    cancel()
+    <-release
+    if err := <-first; err != context.Canceled {
+        t.Fatalf("first err = %v", err)
+    }
+    select {
+    case err := <-second:
+        if err != nil {
+            t.Fatalf("second err = %v", err)
+        }
+    case <-time.After(3 * time.Second):
+        t.Fatal("second call blocked")
+    }
+}
@@ -0,0 +1,237 @@
+package client
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net"
+    "net/url"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// KVPair.Value 中 SRV 记录的元数据
+const (
+    MetaPriority = "priority"
+)
+
+type (
+    // 测试时可替换为进程内的实现, *net.Resolver 满足该接口
+    DNSResolver interface {
+        LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+        LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+    }
+    DNSOption struct {
+        // 设置 Service 时查询 _service._proto.name 的 SRV 记录,
+        // 否则查询 name 的 A/AAAA 记录并使用固定的 Port
+        Name     string
+        Service  string
+        Proto    string // 默认 tcp
+        Port     int
+        Network  string        // 地址前缀, 如 kcp, 默认 tcp
+        Interval time.Duration // 重新解析的间隔, 默认 30 秒
+        Timeout  time.Duration // 每次解析的超时, 默认 5 秒
+        Resolver DNSResolver   // 默认 net.DefaultResolver
+    }
+    // 通过 DNS 发现服务器, 定时重新解析并推送变化
+    DNSDiscovery struct {
+        option   DNSOption
+        mutex    sync.RWMutex
+        pairs    KVPairs
+        watchers serviceWatchers
+        exitCh   chan struct{}
+        once     sync.Once
+    }
+)
+
+func NewDNSDiscovery(option DNSOption) (*DNSDiscovery, error) {
+    if option.Name == "" {
+        return nil, ErrorServerAddressInvalid
+    }
+    if option.Service == "" && option.Port <= 0 {
+        return nil, fmt.Errorf("dns discovery %s: port required without srv service", option.Name)
+    }
+    if option.Proto == "" {
+        option.Proto = "tcp"
+    }
+    if option.Interval <= 0 {
+        option.Interval = 30 * time.Second
+    }
+    if option.Timeout <= 0 {
+        option.Timeout = 5 * time.Second
+    }
+    if option.Resolver == nil {
+        option.Resolver = net.DefaultResolver
+    }
+    d := &DNSDiscovery{
+        option: option,
+        exitCh: make(chan struct{}),
+    }
+    pairs, err := d.resolve()
+    if err != nil {
+        return nil, err
+    }
+    d.pairs = pairs
+    go d.poll()
+    return d, nil
+}
+
+func (d *DNSDiscovery) GetServices() KVPairs {
+    d.mutex.RLock()
+    defer d.mutex.RUnlock()
+    return d.pairs
+}
+
+func (d *DNSDiscovery) WatchServices() <-chan KVPairs {
+    return d.watchers.watch()
+}
+
+func (d *DNSDiscovery) Close() {
+    d.once.Do(func() {
+        close(d.exitCh)
+        d.watchers.close()
+    })
+}
+
+func (d *DNSDiscovery) poll() {
+    ticker := time.NewTicker(d.option.Interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-d.exitCh:
+            return
+        case <-ticker.C:
+            d.reload()
+        }
+    }
+}
+
+// 解析失败时保留原来的列表
+func (d *DNSDiscovery) reload() {
+    pairs, err := d.resolve()
+    if err != nil {
+        log.Println(d.option.Name, err)
+        return
+    }
+    d.mutex.Lock()
+    changed := !reflect.DeepEqual(d.pairs, pairs)
+    d.pairs = pairs
+    d.mutex.Unlock()
+    if changed {
+        d.watchers.notify(pairs)
+    }
+}
+
+func (d *DNSDiscovery) resolve() (KVPairs, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), d.option.Timeout)
+    defer cancel()
+    if d.option.Service != "" {
+        return d.resolveSRV(ctx)
+    }
+    return d.resolveIP(ctx)
+}
+
+// 同 RFC 2782, 只使用 priority 最小且目标能解析的一组记录, 其他组作为备用
+// weight 写入元数据: 组内有大于 0 的 weight 时, weight 为 0 的记录只分到很少的调用,
+// 因此 weight 放大 srvWeightScale 倍, 0 记为 1; 都为 0 时平均分配
+func (d *DNSDiscovery) resolveSRV(ctx context.Context) (KVPairs, error) {
+    _, records, err := d.option.Resolver.LookupSRV(ctx, d.option.Service, d.option.Proto, d.option.Name)
+    if err != nil {
+        return nil, err
+    }
+    sort.SliceStable(records, func(i, j int) bool {
+        if records[i].Priority != records[j].Priority {
+            return records[i].Priority < records[j].Priority
+        }
+        return records[i].Target < records[j].Target
+    })
+    for i := 0; i < len(records); {
+        j := i
+        for j < len(records) && records[j].Priority == records[i].Priority {
+            j++
+        }
+        if pairs := d.srvGroup(ctx, records[i:j]); len(pairs) > 0 {
+            return pairs, nil
+        }
+        i = j
+    }
+    // 目标都为 "." 表示服务不可用, 否则为解析失败, 保留原来的列表
+    for _, r := range records {
+        if strings.TrimSuffix(r.Target, ".") != "" {
+            return nil, fmt.Errorf("dns discovery %s: no srv target resolves", d.option.Name)
+        }
+    }
+    return KVPairs{}, nil
+}
+
+const srvWeightScale = 100
+
+// 同一 priority 的记录, 去掉目标为 "." 或无法解析的
+func (d *DNSDiscovery) srvGroup(ctx context.Context, records []*net.SRV) KVPairs {
+    var (
+        hosts    []string
+        selected []*net.SRV
+        weighted bool
+    )
+    for _, r := range records {
+        host := strings.TrimSuffix(r.Target, ".")
+        if host == "" || !d.resolvable(ctx, host) {
+            continue
+        }
+        hosts = append(hosts, host)
+        selected = append(selected, r)
+        weighted = weighted || r.Weight > 0
+    }
+    pairs := make(KVPairs, 0, len(selected))
+    for i, r := range selected {
+        weight := 1
+        if weighted && r.Weight > 0 {
+            weight = int(r.Weight) * srvWeightScale
+        }
+        meta := url.Values{}
+        meta.Set(MetaPriority, strconv.Itoa(int(r.Priority)))
+        meta.Set(MetaWeight, strconv.Itoa(weight))
+        pairs = append(pairs, KVPair{
+            Key:   d.key(hosts[i], int(r.Port)),
+            Value: meta.Encode(),
+        })
+    }
+    return pairs
+}
+
+func (d *DNSDiscovery) resolvable(ctx context.Context, host string) bool {
+    if net.ParseIP(host) != nil {
+        return true
+    }
+    addrs, err := d.option.Resolver.LookupIPAddr(ctx, host)
+    return err == nil && len(addrs) > 0
+}
+
+func (d *DNSDiscovery) resolveIP(ctx context.Context) (KVPairs, error) {
+    addrs, err := d.option.Resolver.LookupIPAddr(ctx, d.option.Name)
+    if err != nil {
+        return nil, err
+    }
+    hosts := make([]string, 0, len(addrs))
+    for _, addr := range addrs {
+        hosts = append(hosts, addr.String())
+    }
+    sort.Strings(hosts)
+    pairs := make(KVPairs, 0, len(hosts))
+    for _, host := range hosts {
+        pairs = append(pairs, KVPair{Key: d.key(host, d.option.Port)})
+    }
+    return pairs, nil
+}
+
+func (d *DNSDiscovery) key(host string, port int) string {
+    addr := net.JoinHostPort(host, strconv.Itoa(port))
+    if d.option.Network == "" || d.option.Network == "tcp" {
+        return addr
+    }
+    return d.option.Network + "@" + addr
+}
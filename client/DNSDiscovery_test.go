@@ -0,0 +1,205 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "net"
+    "sync"
+    "testing"
+    "time"
+)
+
+// 进程内的 DNS, 记录可在运行中修改
+type fakeResolver struct {
+    mutex sync.Mutex
+    srv   map[string][]*net.SRV
+    hosts map[string][]net.IPAddr
+}
+
+var errNoSuchHost = errors.New("no such host")
+
+func newFakeResolver() *fakeResolver {
+    return &fakeResolver{
+        srv:   make(map[string][]*net.SRV),
+        hosts: make(map[string][]net.IPAddr),
+    }
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    cname := "_" + service + "._" + proto + "." + name
+    records, ok := r.srv[cname]
+    if !ok {
+        return "", nil, errNoSuchHost
+    }
+    // 返回副本, 调用方会排序
+    result := make([]*net.SRV, len(records))
+    for i, v := range records {
+        srv := *v
+        result[i] = &srv
+    }
+    return cname, result, nil
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    addrs, ok := r.hosts[host]
+    if !ok {
+        return nil, errNoSuchHost
+    }
+    return append([]net.IPAddr(nil), addrs...), nil
+}
+
+func (r *fakeResolver) setSRV(name string, records ...*net.SRV) {
+    r.mutex.Lock()
+    r.srv[name] = records
+    r.mutex.Unlock()
+}
+
+func (r *fakeResolver) setHost(host string, ips ...string) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if len(ips) == 0 {
+        delete(r.hosts, host)
+        return
+    }
+    addrs := make([]net.IPAddr, 0, len(ips))
+    for _, ip := range ips {
+        addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+    }
+    r.hosts[host] = addrs
+}
+
+func keysOf(pairs KVPairs) []string {
+    keys := make([]string, 0, len(pairs))
+    for _, kv := range pairs {
+        keys = append(keys, kv.Key)
+    }
+    return keys
+}
+
+func equalKeys(pairs KVPairs, want ...string) bool {
+    keys := keysOf(pairs)
+    if len(keys) != len(want) {
+        return false
+    }
+    for i := range keys {
+        if keys[i] != want[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func TestDNSDiscoverySRVPriority(t *testing.T) {
+    r := newFakeResolver()
+    for _, host := range []string{"a.example", "b.example", "c.example", "d.example"} {
+        r.setHost(host, "10.0.0.1")
+    }
+    r.setSRV("_game._tcp.example",
+        &net.SRV{Target: "d.example.", Port: 4000, Priority: 20, Weight: 10},
+        &net.SRV{Target: "b.example.", Port: 3000, Priority: 10, Weight: 30},
+        &net.SRV{Target: "a.example.", Port: 3000, Priority: 10, Weight: 10},
+        &net.SRV{Target: "c.example.", Port: 3000, Priority: 10, Weight: 0},
+    )
+    d, err := NewDNSDiscovery(DNSOption{Name: "example", Service: "game", Resolver: r, Interval: time.Hour})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+
+    // 只使用 priority 最小的一组, 组内按目标排序
+    pairs := d.GetServices()
+    if !equalKeys(pairs, "a.example:3000", "b.example:3000", "c.example:3000") {
+        t.Fatalf("servers = %v", keysOf(pairs))
+    }
+    if p := pairs[0].Metadata().Get(MetaPriority); p != "10" {
+        t.Fatalf("priority = %q", p)
+    }
+    // weight 保持比例, 0 只分到很少的调用
+    if a, b, c := pairs[0].Weight(), pairs[1].Weight(), pairs[2].Weight(); b != 3*a || c >= a/10 {
+        t.Fatalf("weights = %d %d %d", a, b, c)
+    }
+}
+
+func TestDNSDiscoverySRVFallback(t *testing.T) {
+    r := newFakeResolver()
+    r.setHost("backup.example", "10.0.0.2")
+    r.setSRV("_game._tcp.example",
+        &net.SRV{Target: "primary.example.", Port: 3000, Priority: 10},
+        &net.SRV{Target: "backup.example.", Port: 3000, Priority: 20},
+        &net.SRV{Target: "spare.example.", Port: 3000, Priority: 20},
+    )
+    d, err := NewDNSDiscovery(DNSOption{Name: "example", Service: "game", Resolver: r, Interval: time.Hour})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+
+    // priority 10 的目标无法解析, 使用下一组中能解析的目标, weight 都为 0 时平均分配
+    pairs := d.GetServices()
+    if !equalKeys(pairs, "backup.example:3000") || pairs[0].Weight() != 1 {
+        t.Fatalf("servers = %v", pairs)
+    }
+
+    // 没有能解析的目标时创建失败
+    r.setHost("backup.example")
+    if _, err := NewDNSDiscovery(DNSOption{Name: "example", Service: "game", Resolver: r}); err == nil {
+        t.Fatal("expected error when no srv target resolves")
+    }
+}
+
+func TestDNSDiscoveryAddress(t *testing.T) {
+    r := newFakeResolver()
+    r.setHost("game.example", "10.0.0.2", "10.0.0.1", "fd00::1")
+    d, err := NewDNSDiscovery(DNSOption{Name: "game.example", Port: 9527, Network: "kcp", Resolver: r, Interval: time.Hour})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+    if pairs := d.GetServices(); !equalKeys(pairs, "kcp@10.0.0.1:9527", "kcp@10.0.0.2:9527", "kcp@[fd00::1]:9527") {
+        t.Fatalf("servers = %v", keysOf(pairs))
+    }
+
+    if _, err := NewDNSDiscovery(DNSOption{Name: "game.example", Resolver: r}); err == nil {
+        t.Fatal("expected error without port")
+    }
+}
+
+func TestDNSDiscoveryWatch(t *testing.T) {
+    r := newFakeResolver()
+    r.setHost("game.example", "10.0.0.1")
+    d, err := NewDNSDiscovery(DNSOption{Name: "game.example", Port: 9527, Resolver: r, Interval: 10 * time.Millisecond})
+    if err != nil {
+        t.Fatal(err)
+    }
+    ch := d.WatchServices()
+
+    r.setHost("game.example", "10.0.0.1", "10.0.0.2")
+    select {
+    case pairs := <-ch:
+        if !equalKeys(pairs, "10.0.0.1:9527", "10.0.0.2:9527") {
+            t.Fatalf("servers = %v", keysOf(pairs))
+        }
+    case <-time.After(time.Second):
+        t.Fatal("no update after records changed")
+    }
+
+    // 解析失败时保留原来的列表, 不推送
+    r.setHost("game.example")
+    select {
+    case pairs := <-ch:
+        t.Fatalf("unexpected update %v", keysOf(pairs))
+    case <-time.After(50 * time.Millisecond):
+    }
+    if pairs := d.GetServices(); len(pairs) != 2 {
+        t.Fatalf("servers = %v", keysOf(pairs))
+    }
+
+    d.Close()
+    if _, ok := <-ch; ok {
+        t.Fatal("watch channel not closed")
+    }
+}
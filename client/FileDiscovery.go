@@ -0,0 +1,143 @@
+package client
+
+import (
+    "encoding/json"
+    "gopkg.in/yaml.v2"
+    "io/ioutil"
+    "log"
+    "net"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+    "time"
+)
+
+type (
+    // 从文件读取服务器列表, 文件变化后重新读取并推送
+    // .yaml/.yml 按 YAML 解析, 其他按 JSON 解析, 内容为 KVPair 列表:
+    //   [{"key": "tcp@127.0.0.1:9527", "value": "weight=10&zone=a"}]
+    FileDiscovery struct {
+        path     string
+        interval time.Duration
+        mutex    sync.RWMutex
+        pairs    KVPairs
+        modTime  time.Time
+        size     int64
+        watchers serviceWatchers
+        exitCh   chan struct{}
+        once     sync.Once
+    }
+)
+
+const defaultFilePollInterval = time.Second
+
+// interval 为检查文件修改时间的间隔, 0 为默认 1 秒
+func NewFileDiscovery(path string, interval time.Duration) (*FileDiscovery, error) {
+    if interval <= 0 {
+        interval = defaultFilePollInterval
+    }
+    d := &FileDiscovery{
+        path:     path,
+        interval: interval,
+        exitCh:   make(chan struct{}),
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        return nil, err
+    }
+    pairs, err := readServerFile(path)
+    if err != nil {
+        return nil, err
+    }
+    d.pairs = pairs
+    d.modTime = info.ModTime()
+    d.size = info.Size()
+    go d.poll()
+    return d, nil
+}
+
+// 不包含 state=inactive 的服务器
+func (d *FileDiscovery) GetServices() KVPairs {
+    d.mutex.RLock()
+    defer d.mutex.RUnlock()
+    return d.pairs.Active()
+}
+
+func (d *FileDiscovery) WatchServices() <-chan KVPairs {
+    return d.watchers.watch()
+}
+
+func (d *FileDiscovery) Close() {
+    d.once.Do(func() {
+        close(d.exitCh)
+        d.watchers.close()
+    })
+}
+
+func (d *FileDiscovery) poll() {
+    ticker := time.NewTicker(d.interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-d.exitCh:
+            return
+        case <-ticker.C:
+            d.reload()
+        }
+    }
+}
+
+// 文件修改时间或大小变化时重新读取, 内容有误时保留原来的列表
+func (d *FileDiscovery) reload() {
+    info, err := os.Stat(d.path)
+    if err != nil {
+        log.Println(err)
+        return
+    }
+    if info.ModTime().Equal(d.modTime) && info.Size() == d.size {
+        return
+    }
+    d.modTime = info.ModTime()
+    d.size = info.Size()
+    pairs, err := readServerFile(d.path)
+    if err != nil {
+        log.Println(d.path, err)
+        return
+    }
+    d.mutex.Lock()
+    changed := !reflect.DeepEqual(d.pairs, pairs)
+    d.pairs = pairs
+    d.mutex.Unlock()
+    if changed {
+        d.watchers.notify(pairs.Active())
+    }
+}
+
+func readServerFile(path string) (KVPairs, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var pairs KVPairs
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".yaml", ".yml":
+        err = yaml.Unmarshal(data, &pairs)
+    default:
+        err = json.Unmarshal(data, &pairs)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err = validatePairs(pairs); err != nil {
+        return nil, err
+    }
+    for _, kv := range pairs {
+        _, addr := splitNetworkAndAddress(kv.Key)
+        if _, _, err = net.SplitHostPort(addr); err != nil {
+            return nil, err
+        }
+    }
+    return pairs, nil
+}
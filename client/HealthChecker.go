@@ -0,0 +1,160 @@
+package client
+
+import (
+    "context"
+    "github.com/DGHeroin/rpc.go"
+    "log"
+    "sync"
+    "time"
+)
+
+// 定时向每个服务器发送 ping, 连续失败 MaxFailures 次后不再选择, 成功一次后恢复
+type HealthCheckOption struct {
+    Interval    time.Duration // 检查间隔, 默认 5 秒
+    Timeout     time.Duration // 建立链接和等待 pong 的时间, 默认 1 秒
+    MaxFailures int           // 默认 3
+    // 同时 Watch 服务器健康服务中 servicePath 的状态, 变为 NOT_SERVING 时立即不再选择,
+    // ping 只说明链接正常, 健康服务说明是否可以处理请求
+    Service bool
+}
+
+const (
+    defaultHealthCheckInterval    = 5 * time.Second
+    defaultHealthCheckTimeout     = time.Second
+    defaultHealthCheckMaxFailures = 3
+)
+
+func (c *xClient) healthCheckLoop(option HealthCheckOption) {
+    if option.Interval <= 0 {
+        option.Interval = defaultHealthCheckInterval
+    }
+    if option.Timeout <= 0 {
+        option.Timeout = defaultHealthCheckTimeout
+    }
+    if option.MaxFailures <= 0 {
+        option.MaxFailures = defaultHealthCheckMaxFailures
+    }
+    ticker := time.NewTicker(option.Interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-c.exitCh:
+            return
+        case <-ticker.C:
+            c.checkServers(option)
+        }
+    }
+}
+
+// 并发检查所有服务器, 全部完成后返回
+func (c *xClient) checkServers(option HealthCheckOption) {
+    c.mutex.RLock()
+    servers := make([]string, 0, len(c.servers))
+    for addr := range c.servers {
+        servers = append(servers, addr)
+    }
+    c.mutex.RUnlock()
+    if option.Service {
+        for _, addr := range servers {
+            c.mutex.Lock()
+            watching := c.watching[addr]
+            c.watching[addr] = true
+            c.mutex.Unlock()
+            if !watching {
+                go c.watchHealth(addr)
+            }
+        }
+    }
+    var wg sync.WaitGroup
+    for _, addr := range servers {
+        wg.Add(1)
+        go func(addr string) {
+            defer wg.Done()
+            c.setHealth(addr, c.checkServer(addr, option.Timeout), option.MaxFailures)
+        }(addr)
+    }
+    wg.Wait()
+}
+
+// 使用缓存的链接, 没有时建立链接, 都受 timeout 限制
+func (c *xClient) checkServer(addr string, timeout time.Duration) error {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    cli, err := c.getClient(addr)
+    if err != nil {
+        return err
+    }
+    _, err = cli.Ping(ctx)
+    return err
+}
+
+func (c *xClient) setHealth(addr string, err error, maxFailures int) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if _, ok := c.servers[addr]; !ok {
+        return
+    }
+    if err == nil {
+        delete(c.failures, addr)
+        if c.unhealthy[addr] {
+            delete(c.unhealthy, addr)
+            log.Println(addr, "healthy")
+            c.updateSelector()
+        }
+        return
+    }
+    c.failures[addr]++
+    if c.failures[addr] >= maxFailures && !c.unhealthy[addr] {
+        c.unhealthy[addr] = true
+        log.Println(addr, "unhealthy:", err)
+        c.updateSelector()
+    }
+}
+
+// 持续 Watch 直到服务器被移除或出错, 下一轮检查时重新开始
+func (c *xClient) watchHealth(addr string) {
+    defer func() {
+        c.mutex.Lock()
+        delete(c.watching, addr)
+        c.mutex.Unlock()
+    }()
+    var known rpc.HealthStatus
+    for {
+        select {
+        case <-c.exitCh:
+            return
+        default:
+        }
+        c.mutex.RLock()
+        _, ok := c.servers[addr]
+        c.mutex.RUnlock()
+        if !ok {
+            return
+        }
+        cli, err := c.getClient(addr)
+        if err != nil {
+            return
+        }
+        status, err := cli.WatchHealth(context.Background(), c.servicePath, known)
+        if err != nil {
+            return
+        }
+        known = status
+        c.setServing(addr, status != rpc.HealthNotServing)
+    }
+}
+
+func (c *xClient) setServing(addr string, serving bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if _, ok := c.servers[addr]; !ok || c.notServing[addr] == !serving {
+        return
+    }
+    if serving {
+        delete(c.notServing, addr)
+    } else {
+        c.notServing[addr] = true
+    }
+    log.Println(addr, c.servicePath, "serving:", serving)
+    c.updateSelector()
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+)
+
+// 建立链接不返回的服务器不拖住整轮检查, 超时后记为失败
+func TestHealthCheckDialTimeout(t *testing.T) {
+    up := startServer(t, "up", 0, nil)
+    blackhole := "tcp@192.0.2.1:9527"
+    d, _ := NewMultipleServersDiscovery(KVPairs{{Key: up}, {Key: blackhole}})
+    defer d.Close()
+    c := NewClient("game", d, DefaultOption).(*xClient)
+    defer c.Close()
+    // 模拟丢弃 SYN 的地址, 建立链接只在 ctx 结束时返回
+    c.mutex.Lock()
+    c.cachedClient[blackhole] = newConnPool(1, c.option.ClientOption, func(ctx context.Context) (net.Conn, error) {
+        <-ctx.Done()
+        return nil, ctx.Err()
+    })
+    c.mutex.Unlock()
+
+    start := time.Now()
+    c.checkServers(HealthCheckOption{Timeout: 50 * time.Millisecond, MaxFailures: 1})
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Fatalf("check round took %v", elapsed)
+    }
+    c.mutex.RLock()
+    defer c.mutex.RUnlock()
+    if !c.unhealthy[blackhole] || c.unhealthy[up] {
+        t.Fatalf("unhealthy = %v", c.unhealthy)
+    }
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+    "net/url"
+    "sync"
+)
+
+type (
+    // 固定的多个服务器, 可以在运行时通过 Update 修改
+    MultipleServersDiscovery struct {
+        mutex    sync.RWMutex
+        pairs    KVPairs
+        watchers serviceWatchers
+    }
+)
+
+func NewMultipleServersDiscovery(pairs KVPairs) (*MultipleServersDiscovery, error) {
+    if err := validatePairs(pairs); err != nil {
+        return nil, err
+    }
+    return &MultipleServersDiscovery{pairs: pairs}, nil
+}
+
+// 从 "tcp@127.0.0.1:9527?weight=10" 形式的配置创建
+func NewMultipleServersDiscoveryFromStrings(servers []string) (*MultipleServersDiscovery, error) {
+    pairs := make(KVPairs, 0, len(servers))
+    for _, s := range servers {
+        kv, err := ParseKVPair(s)
+        if err != nil {
+            return nil, err
+        }
+        pairs = append(pairs, kv)
+    }
+    return NewMultipleServersDiscovery(pairs)
+}
+
+// 不包含 state=inactive 的服务器
+func (d *MultipleServersDiscovery) GetServices() KVPairs {
+    d.mutex.RLock()
+    defer d.mutex.RUnlock()
+    return d.pairs.Active()
+}
+
+func (d *MultipleServersDiscovery) WatchServices() <-chan KVPairs {
+    return d.watchers.watch()
+}
+
+// 替换服务器列表并推送给所有 watcher
+// 在锁内推送, 并发的 Update 按写入的顺序到达 watcher, notify 不会阻塞
+func (d *MultipleServersDiscovery) Update(pairs KVPairs) error {
+    if err := validatePairs(pairs); err != nil {
+        return err
+    }
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    d.pairs = pairs
+    d.watchers.notify(pairs.Active())
+    return nil
+}
+
+func (d *MultipleServersDiscovery) Close() {
+    d.watchers.close()
+}
+
+func validatePairs(pairs KVPairs) error {
+    for _, kv := range pairs {
+        if kv.Key == "" {
+            return ErrorServerAddressInvalid
+        }
+        if _, err := url.ParseQuery(kv.Value); err != nil {
+            return err
+        }
+    }
+    return nil
+}
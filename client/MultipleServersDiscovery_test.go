@@ -0,0 +1,52 @@
+package client
+
+import (
+    "strconv"
+    "sync"
+    "testing"
+)
+
+// 并发 Update 后 watcher 最后收到的列表与 GetServices 一致
+func TestMultipleServersDiscoveryUpdateOrder(t *testing.T) {
+    d, _ := NewMultipleServersDiscovery(nil)
+    defer d.Close()
+    ch := d.WatchServices()
+    for round := 0; round < 50; round++ {
+        var wg sync.WaitGroup
+        for i := 0; i < 8; i++ {
+            wg.Add(1)
+            go func(i int) {
+                defer wg.Done()
+                _ = d.Update(KVPairs{{Key: "tcp@127.0.0.1:" + strconv.Itoa(9000+i)}})
+            }(i)
+        }
+        wg.Wait()
+        var last KVPairs
+    drain:
+        for {
+            select {
+            case last = <-ch:
+            default:
+                break drain
+            }
+        }
+        if current := d.GetServices(); len(last) != 1 || last[0].Key != current[0].Key {
+            t.Fatalf("round %d: watcher got %v, GetServices = %v", round, last, current)
+        }
+    }
+}
+
+// state=inactive 的服务器不推送
+func TestMultipleServersDiscoveryInactive(t *testing.T) {
+    d, err := NewMultipleServersDiscoveryFromStrings([]string{"tcp@127.0.0.1:9001?weight=10", "tcp@127.0.0.1:9002?state=inactive"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+    if pairs := d.GetServices(); len(pairs) != 1 || pairs[0].Key != "tcp@127.0.0.1:9001" || pairs[0].Value != "weight=10" {
+        t.Fatalf("GetServices = %v", pairs)
+    }
+    if err := d.Update(KVPairs{{Key: ""}}); err != ErrorServerAddressInvalid {
+        t.Fatalf("Update err = %v", err)
+    }
+}
@@ -20,3 +20,11 @@ func (p *Peer2PeerDiscovery) GetServices() KVPairs {
         },
     }
 }
+
+// 地址固定, 不会变化
+func (p *Peer2PeerDiscovery) WatchServices() <-chan KVPairs {
+    return nil
+}
+
+func (p *Peer2PeerDiscovery) Close() {
+}
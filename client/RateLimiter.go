@@ -0,0 +1,114 @@
+package client
+
+import (
+    "context"
+    "github.com/DGHeroin/rpc.go/common"
+    "sync"
+    "time"
+)
+
+type (
+    // 调用方的限流, 保护下游服务
+    RateLimitOption struct {
+        Rate        float64 // 每个 serviceMethod 每秒允许的调用数, 0 为不限制
+        Burst       int     // 令牌桶的容量, 默认为 Rate 向上取整
+        MaxInFlight int     // 整个 xClient 同时进行的调用数, 0 为不限制
+        // 超过限制时等待, 直到 context 结束, 否则立即返回 ErrRateLimited
+        Wait bool
+    }
+    rateLimiter struct {
+        option  RateLimitOption
+        mutex   sync.Mutex
+        buckets map[string]*common.TokenBucket
+        sem     chan struct{}
+    }
+)
+
+var ErrRateLimited = common.ErrorRateLimited
+
+func newRateLimiter(option RateLimitOption) *rateLimiter {
+    l := &rateLimiter{
+        option:  option,
+        buckets: make(map[string]*common.TokenBucket),
+    }
+    if option.MaxInFlight > 0 {
+        l.sem = make(chan struct{}, option.MaxInFlight)
+    }
+    return l
+}
+
+// 取得令牌和并发名额, 调用结束后需调用 release
+// 等待模式下 context 结束前拿不到令牌时直接返回 ErrRateLimited; 拿不到并发名额时归还令牌
+func (l *rateLimiter) acquire(ctx context.Context, key string) (release func(), err error) {
+    var bucket *common.TokenBucket
+    if l.option.Rate > 0 {
+        if bucket, err = l.take(ctx, key); err != nil {
+            return nil, err
+        }
+    }
+    if l.sem == nil {
+        return func() {}, nil
+    }
+    if l.option.Wait {
+        select {
+        case l.sem <- struct{}{}:
+        case <-ctx.Done():
+            l.cancel(bucket)
+            return nil, ctx.Err()
+        }
+    } else {
+        select {
+        case l.sem <- struct{}{}:
+        default:
+            l.cancel(bucket)
+            return nil, ErrRateLimited
+        }
+    }
+    return func() {
+        <-l.sem
+    }, nil
+}
+
+// 返回取得令牌的令牌桶, 用于之后归还
+func (l *rateLimiter) take(ctx context.Context, key string) (*common.TokenBucket, error) {
+    now := time.Now()
+    l.mutex.Lock()
+    b, ok := l.buckets[key]
+    if !ok {
+        b = common.NewTokenBucket(l.option.Rate, l.option.Burst, now)
+        l.buckets[key] = b
+    }
+    wait := b.Reserve(now)
+    if wait > 0 && !l.option.Wait {
+        b.Cancel()
+        l.mutex.Unlock()
+        return nil, ErrRateLimited
+    }
+    l.mutex.Unlock()
+    if wait <= 0 {
+        return b, nil
+    }
+    if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(wait)) {
+        l.cancel(b)
+        return nil, ErrRateLimited
+    }
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return b, nil
+    case <-ctx.Done():
+        l.cancel(b)
+        return nil, ctx.Err()
+    }
+}
+
+// 归还令牌, 不限速率时 b 为 nil
+func (l *rateLimiter) cancel(b *common.TokenBucket) {
+    if b == nil {
+        return
+    }
+    l.mutex.Lock()
+    b.Cancel()
+    l.mutex.Unlock()
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestRateLimiterReject(t *testing.T) {
+    l := newRateLimiter(RateLimitOption{Rate: 10, Burst: 2})
+    for i := 0; i < 2; i++ {
+        if _, err := l.acquire(context.Background(), "game/Name"); err != nil {
+            t.Fatalf("acquire %d: %v", i, err)
+        }
+    }
+    if _, err := l.acquire(context.Background(), "game/Name"); err != ErrRateLimited {
+        t.Fatalf("err = %v", err)
+    }
+    // 每个 serviceMethod 单独限制
+    if _, err := l.acquire(context.Background(), "game/Other"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestRateLimiterWait(t *testing.T) {
+    l := newRateLimiter(RateLimitOption{Rate: 20, Burst: 1, Wait: true})
+    if _, err := l.acquire(context.Background(), "k"); err != nil {
+        t.Fatal(err)
+    }
+    start := time.Now()
+    if _, err := l.acquire(context.Background(), "k"); err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+        t.Fatalf("waited %v", elapsed)
+    }
+
+    // deadline 之前拿不到令牌时立即返回, 不等待
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    start = time.Now()
+    if _, err := l.acquire(ctx, "k"); err != ErrRateLimited {
+        t.Fatalf("err = %v", err)
+    }
+    if elapsed := time.Since(start); elapsed > 5*time.Millisecond {
+        t.Fatalf("returned after %v", elapsed)
+    }
+    // 返回的令牌可以被下一个调用使用
+    time.Sleep(60 * time.Millisecond)
+    ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    if _, err := l.acquire(ctx, "k"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestRateLimiterMaxInFlight(t *testing.T) {
+    l := newRateLimiter(RateLimitOption{MaxInFlight: 1})
+    release, err := l.acquire(context.Background(), "k")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := l.acquire(context.Background(), "k"); err != ErrRateLimited {
+        t.Fatalf("err = %v", err)
+    }
+    release()
+    release, err = l.acquire(context.Background(), "k")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    w := newRateLimiter(RateLimitOption{MaxInFlight: 1, Wait: true})
+    wrelease, _ := w.acquire(context.Background(), "k")
+    ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    if _, err := w.acquire(ctx, "k"); err != context.DeadlineExceeded {
+        t.Fatalf("err = %v", err)
+    }
+    go func() {
+        time.Sleep(20 * time.Millisecond)
+        wrelease()
+    }()
+    if _, err := w.acquire(context.Background(), "k"); err != nil {
+        t.Fatal(err)
+    }
+    release()
+}
+
+// 拿不到并发名额时归还令牌
+func TestRateLimiterRefundsToken(t *testing.T) {
+    l := newRateLimiter(RateLimitOption{Rate: 0.001, Burst: 2, MaxInFlight: 1})
+    release, err := l.acquire(context.Background(), "k")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := l.acquire(context.Background(), "k"); err != ErrRateLimited {
+        t.Fatalf("err = %v", err)
+    }
+    release()
+    if _, err := l.acquire(context.Background(), "k"); err != nil {
+        t.Fatalf("token not refunded: %v", err)
+    }
+}
@@ -2,49 +2,422 @@ package client
 
 import (
     "context"
+    "crypto/md5"
+    "encoding/binary"
+    "errors"
+    "fmt"
     "math/rand"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
 )
 
 type Selector interface {
     Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string
+    // 服务器列表变化时调用, 保留仍存在的服务器的状态
+    UpdateServer(servers KVPairs)
 }
 
 type SelectMode int
 
 const (
     RandomSelect SelectMode = iota
+    RoundRobin
+    WeightedRoundRobin // 权重取自元数据中的 weight
+    ConsistentHash     // 按 servicePath 和调用方的 key 选择, 同一 key 的所有方法选中同一服务器, 见 WithSelectKey
+    WeightedLatency    // 按调用延迟的 EWMA 加权随机, 延迟越低越容易选中
+    LeastActive        // 选择进行中的调用最少的服务器
 )
 
-func newSelector(selectMode SelectMode, servers []string) Selector {
+func newSelector(selectMode SelectMode, servers KVPairs) Selector {
     switch selectMode {
     case RandomSelect:
         return newRandomSelect(servers)
+    case RoundRobin:
+        return newRoundRobinSelector(servers)
+    case WeightedRoundRobin:
+        return newWeightedRoundRobinSelector(servers)
+    case ConsistentHash:
+        return newConsistentHashSelector(servers)
+    case WeightedLatency:
+        return newWeightedLatencySelector(servers)
+    case LeastActive:
+        return newLeastActiveSelector(servers)
     default:
         return newRandomSelect(servers)
     }
 }
 
-func newRandomSelect(servers []string) Selector {
-    return &randomSelector{servers: servers}
+func newRandomSelect(servers KVPairs) Selector {
+    return &randomSelector{servers: servers.Keys()}
 }
 
 // randomSelector selects randomly.
 type randomSelector struct {
+    mutex   sync.RWMutex
     servers []string
 }
 
-func newRandomSelector(servers map[string]string) Selector {
-    ss := make([]string, 0, len(servers))
-    for k := range servers {
-        ss = append(ss, k)
+func (s *randomSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+    ss := s.servers
+    if len(ss) == 0 {
+        return ""
     }
+    return ss[rand.Intn(len(ss))]
+}
 
-    return &randomSelector{servers: ss}
+func (s *randomSelector) UpdateServer(servers KVPairs) {
+    s.mutex.Lock()
+    s.servers = servers.Keys()
+    s.mutex.Unlock()
 }
-func (s randomSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+
+// roundRobinSelector selects servers in turn.
+type roundRobinSelector struct {
+    mutex   sync.Mutex
+    servers []string
+    i       int
+}
+
+func newRoundRobinSelector(servers KVPairs) Selector {
+    return &roundRobinSelector{servers: servers.Keys()}
+}
+
+func (s *roundRobinSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
     ss := s.servers
     if len(ss) == 0 {
         return ""
     }
-    return ss[rand.Intn(len(ss))]
+    s.i = s.i % len(ss)
+    selected := ss[s.i]
+    s.i++
+    return selected
+}
+
+func (s *roundRobinSelector) UpdateServer(servers KVPairs) {
+    s.mutex.Lock()
+    s.servers = servers.Keys()
+    s.mutex.Unlock()
+}
+
+// weightedRoundRobinSelector selects servers with smooth weighted round-robin (same as nginx).
+type weightedRoundRobinSelector struct {
+    mutex   sync.Mutex
+    servers []*weighted
+}
+
+type weighted struct {
+    server        string
+    weight        int
+    currentWeight int
+}
+
+func newWeightedRoundRobinSelector(servers KVPairs) Selector {
+    s := &weightedRoundRobinSelector{}
+    s.UpdateServer(servers)
+    return s
+}
+
+func (s *weightedRoundRobinSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    var (
+        total int
+        best  *weighted
+    )
+    for _, w := range s.servers {
+        w.currentWeight += w.weight
+        total += w.weight
+        if best == nil || w.currentWeight > best.currentWeight {
+            best = w
+        }
+    }
+    if best == nil {
+        return ""
+    }
+    best.currentWeight -= total
+    return best.server
+}
+
+func (s *weightedRoundRobinSelector) UpdateServer(servers KVPairs) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    old := make(map[string]*weighted, len(s.servers))
+    for _, w := range s.servers {
+        old[w.server] = w
+    }
+    ss := make([]*weighted, 0, len(servers))
+    for _, kv := range servers {
+        weight := kv.Weight()
+        if w, ok := old[kv.Key]; ok && w.weight == weight {
+            ss = append(ss, w)
+            continue
+        }
+        ss = append(ss, &weighted{server: kv.Key, weight: weight})
+    }
+    s.servers = ss
+}
+
+type (
+    selectKeyCtx struct{}
+    // args 实现该接口时, 用 SelectKey 的返回值作为一致性哈希的 key
+    SelectKeyer interface {
+        SelectKey() string
+    }
+)
+
+// 设置一致性哈希使用的 key, 如玩家或房间 id, 优先于 args
+func WithSelectKey(ctx context.Context, key string) context.Context {
+    return context.WithValue(ctx, selectKeyCtx{}, key)
+}
+
+// 依次取 context 中的 key, args.SelectKey(), args 本身
+func selectKey(ctx context.Context, args interface{}) string {
+    if ctx != nil {
+        if key, ok := ctx.Value(selectKeyCtx{}).(string); ok {
+            return key
+        }
+    }
+    switch v := args.(type) {
+    case nil:
+        return ""
+    case SelectKeyer:
+        return v.SelectKey()
+    case string:
+        return v
+    case []byte:
+        return string(v)
+    default:
+        return fmt.Sprint(v)
+    }
+}
+
+const consistentHashReplicas = 100
+
+// consistentHashSelector selects servers by a hash ring with virtual nodes.
+type consistentHashSelector struct {
+    mutex  sync.RWMutex
+    hashes []uint64
+    ring   map[uint64]string
+}
+
+func newConsistentHashSelector(servers KVPairs) Selector {
+    s := &consistentHashSelector{}
+    s.UpdateServer(servers)
+    return s
+}
+
+// serviceMethod 不参与哈希, 需要按方法分散时由调用方把方法加入 key
+func (s *consistentHashSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+    h := hashKey(servicePath + "/" + selectKey(ctx, args))
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+    if len(s.hashes) == 0 {
+        return ""
+    }
+    i := sort.Search(len(s.hashes), func(i int) bool {
+        return s.hashes[i] >= h
+    })
+    if i == len(s.hashes) {
+        i = 0
+    }
+    return s.ring[s.hashes[i]]
+}
+
+// 虚拟节点只与服务器地址有关, 服务器增减时只影响相邻的区间
+func (s *consistentHashSelector) UpdateServer(servers KVPairs) {
+    hashes := make([]uint64, 0, len(servers)*consistentHashReplicas)
+    ring := make(map[uint64]string, len(servers)*consistentHashReplicas)
+    for _, kv := range servers {
+        for i := 0; i < consistentHashReplicas; i++ {
+            h := hashKey(kv.Key + "#" + strconv.Itoa(i))
+            if _, ok := ring[h]; ok {
+                continue
+            }
+            ring[h] = kv.Key
+            hashes = append(hashes, h)
+        }
+    }
+    sort.Slice(hashes, func(i, j int) bool {
+        return hashes[i] < hashes[j]
+    })
+    s.mutex.Lock()
+    s.hashes = hashes
+    s.ring = ring
+    s.mutex.Unlock()
+}
+
+// 与 ketama 一样使用 md5, 相近的 key 也能分散开
+func hashKey(key string) uint64 {
+    sum := md5.Sum([]byte(key))
+    return binary.BigEndian.Uint64(sum[:8])
+}
+
+const (
+    latencyDecay        = 0.3             // 新样本在 EWMA 中的比重
+    latencyErrorPenalty = 1 * time.Second // 服务器故障时的最小延迟样本
+)
+
+// weightedLatencySelector selects servers randomly with weight 1/EWMA(latency).
+type weightedLatencySelector struct {
+    mutex   sync.Mutex
+    servers []string
+    latency map[string]float64 // 纳秒, 没有样本的服务器不在其中
+}
+
+func newWeightedLatencySelector(servers KVPairs) Selector {
+    s := &weightedLatencySelector{latency: make(map[string]float64)}
+    s.UpdateServer(servers)
+    return s
+}
+
+// 没有样本的服务器使用已知延迟的平均值, 保证新服务器也能被选中
+func (s *weightedLatencySelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if len(s.servers) == 0 {
+        return ""
+    }
+    var sum float64
+    for _, v := range s.latency {
+        sum += v
+    }
+    unknown := float64(time.Millisecond)
+    if len(s.latency) > 0 {
+        unknown = sum / float64(len(s.latency))
+    }
+    weights := make([]float64, len(s.servers))
+    var total float64
+    for i, server := range s.servers {
+        latency, ok := s.latency[server]
+        if !ok {
+            latency = unknown
+        }
+        if latency < 1 {
+            latency = 1
+        }
+        weights[i] = 1 / latency
+        total += weights[i]
+    }
+    r := rand.Float64() * total
+    for i, w := range weights {
+        r -= w
+        if r < 0 {
+            return s.servers[i]
+        }
+    }
+    return s.servers[len(s.servers)-1]
+}
+
+func (s *weightedLatencySelector) UpdateServer(servers KVPairs) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.servers = servers.Keys()
+    latency := make(map[string]float64, len(s.servers))
+    for _, server := range s.servers {
+        if v, ok := s.latency[server]; ok {
+            latency[server] = v
+        }
+    }
+    s.latency = latency
+}
+
+func (s *weightedLatencySelector) OnCallStart(server string) {
+}
+
+// 服务端返回的错误按实际延迟计入; 取消的调用(Fork 和 Failbackup 中较慢的一方)没有完整的延迟, 不计入
+func (s *weightedLatencySelector) OnCallDone(server string, latency time.Duration, err error) {
+    if errors.Is(err, context.Canceled) {
+        return
+    }
+    if isServerFailure(err) && latency < latencyErrorPenalty {
+        latency = latencyErrorPenalty
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    found := false
+    for _, v := range s.servers {
+        if v == server {
+            found = true
+            break
+        }
+    }
+    if !found {
+        return
+    }
+    old, ok := s.latency[server]
+    if !ok {
+        s.latency[server] = float64(latency)
+        return
+    }
+    s.latency[server] = old*(1-latencyDecay) + float64(latency)*latencyDecay
+}
+
+// leastActiveSelector selects the server with the fewest in-flight calls.
+type leastActiveSelector struct {
+    mutex   sync.Mutex
+    servers []string
+    active  map[string]int
+}
+
+func newLeastActiveSelector(servers KVPairs) Selector {
+    s := &leastActiveSelector{active: make(map[string]int)}
+    s.UpdateServer(servers)
+    return s
+}
+
+// 并发数相同时随机选择
+func (s *leastActiveSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    var (
+        best  string
+        least = -1
+        count int
+    )
+    for _, server := range s.servers {
+        n := s.active[server]
+        switch {
+        case least < 0 || n < least:
+            best, least, count = server, n, 1
+        case n == least:
+            count++
+            if rand.Intn(count) == 0 {
+                best = server
+            }
+        }
+    }
+    return best
+}
+
+func (s *leastActiveSelector) UpdateServer(servers KVPairs) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.servers = servers.Keys()
+    active := make(map[string]int, len(s.servers))
+    for _, server := range s.servers {
+        if n, ok := s.active[server]; ok {
+            active[server] = n
+        }
+    }
+    s.active = active
+}
+
+func (s *leastActiveSelector) OnCallStart(server string) {
+    s.mutex.Lock()
+    s.active[server]++
+    s.mutex.Unlock()
+}
+
+func (s *leastActiveSelector) OnCallDone(server string, latency time.Duration, err error) {
+    s.mutex.Lock()
+    if s.active[server] > 0 {
+        s.active[server]--
+    }
+    s.mutex.Unlock()
 }
@@ -0,0 +1,165 @@
+package client
+
+import (
+    "context"
+    "github.com/DGHeroin/rpc.go/common"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func selectN(s Selector, n int) []string {
+    result := make([]string, 0, n)
+    for i := 0; i < n; i++ {
+        result = append(result, s.Select(context.Background(), "game", "Login", nil))
+    }
+    return result
+}
+
+func equalStrings(a, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func TestRoundRobin(t *testing.T) {
+    s := newSelector(RoundRobin, KVPairs{{Key: "a"}, {Key: "b"}, {Key: "c"}})
+    if got := selectN(s, 4); !equalStrings(got, []string{"a", "b", "c", "a"}) {
+        t.Fatalf("sequence = %v", got)
+    }
+    s.UpdateServer(KVPairs{{Key: "a"}})
+    if got := selectN(s, 2); !equalStrings(got, []string{"a", "a"}) {
+        t.Fatalf("sequence after update = %v", got)
+    }
+    s.UpdateServer(nil)
+    if got := s.Select(context.Background(), "game", "Login", nil); got != "" {
+        t.Fatalf("select without servers = %q", got)
+    }
+}
+
+// 与 nginx 的平滑加权轮询序列一致
+func TestWeightedRoundRobinSmooth(t *testing.T) {
+    servers := KVPairs{
+        {Key: "a", Value: "weight=5"},
+        {Key: "b", Value: "weight=1"},
+        {Key: "c", Value: "weight=1"},
+    }
+    s := newSelector(WeightedRoundRobin, servers)
+    want := []string{"a", "a", "b", "a", "c", "a", "a"}
+    for round := 0; round < 3; round++ {
+        if got := selectN(s, len(want)); !equalStrings(got, want) {
+            t.Fatalf("round %d sequence = %v, want %v", round, got, want)
+        }
+    }
+}
+
+// 更新列表时保留权重未变的服务器的状态, 不会从头开始
+func TestWeightedRoundRobinUpdateKeepsState(t *testing.T) {
+    servers := KVPairs{
+        {Key: "a", Value: "weight=2"},
+        {Key: "b", Value: "weight=1"},
+    }
+    s := newSelector(WeightedRoundRobin, servers)
+    if got := selectN(s, 1); !equalStrings(got, []string{"a"}) {
+        t.Fatalf("sequence = %v", got)
+    }
+    s.UpdateServer(servers)
+    if got := selectN(s, 5); !equalStrings(got, []string{"b", "a", "a", "b", "a"}) {
+        t.Fatalf("sequence after update = %v", got)
+    }
+
+    // 没有 weight 时为 1
+    s.UpdateServer(KVPairs{{Key: "a"}, {Key: "c"}})
+    counts := make(map[string]int)
+    for _, server := range selectN(s, 10) {
+        counts[server]++
+    }
+    if counts["a"] != 5 || counts["c"] != 5 {
+        t.Fatalf("counts = %v", counts)
+    }
+}
+
+func hashAssignments(s Selector, keys int) map[string]string {
+    result := make(map[string]string, keys)
+    for i := 0; i < keys; i++ {
+        key := "player-" + strconv.Itoa(i)
+        result[key] = s.Select(WithSelectKey(context.Background(), key), "game", "Login", nil)
+    }
+    return result
+}
+
+// 同一 key 的不同方法选中同一服务器
+func TestConsistentHashSameKeyAllMethods(t *testing.T) {
+    s := newSelector(ConsistentHash, KVPairs{{Key: "a"}, {Key: "b"}, {Key: "c"}, {Key: "d"}})
+    for i := 0; i < 100; i++ {
+        key := "room-" + strconv.Itoa(i)
+        ctx := WithSelectKey(context.Background(), key)
+        server := s.Select(ctx, "game", "Join", nil)
+        for _, method := range []string{"Leave", "Chat", "Move"} {
+            if got := s.Select(ctx, "game", method, nil); got != server {
+                t.Fatalf("%s %s = %s, Join = %s", key, method, got, server)
+            }
+        }
+        // args 中的 key 与 context 中的 key 等价
+        if got := s.Select(context.Background(), "game", "Join", key); got != server {
+            t.Fatalf("%s from args = %s, from context = %s", key, got, server)
+        }
+    }
+}
+
+// 增加服务器时只有移到新服务器的 key 变化, 移除时只有原来在该服务器上的 key 变化
+func TestConsistentHashRemapping(t *testing.T) {
+    const keys = 2000
+    servers := KVPairs{{Key: "a"}, {Key: "b"}, {Key: "c"}, {Key: "d"}}
+    s := newSelector(ConsistentHash, servers)
+    before := hashAssignments(s, keys)
+
+    s.UpdateServer(append(servers, KVPair{Key: "e"}))
+    added := hashAssignments(s, keys)
+    moved := 0
+    for key, server := range added {
+        if server == before[key] {
+            continue
+        }
+        if server != "e" {
+            t.Fatalf("%s moved from %s to %s after adding e", key, before[key], server)
+        }
+        moved++
+    }
+    // 期望约 1/5 的 key 移动
+    if moved < keys/10 || moved > keys*3/10 {
+        t.Fatalf("%d of %d keys moved after adding a server", moved, keys)
+    }
+
+    s.UpdateServer(KVPairs{{Key: "a"}, {Key: "b"}, {Key: "d"}})
+    removed := hashAssignments(s, keys)
+    for key, server := range removed {
+        if before[key] != "c" && server != before[key] {
+            t.Fatalf("%s moved from %s to %s after removing c", key, before[key], server)
+        }
+        if server == "c" {
+            t.Fatalf("%s still on removed server", key)
+        }
+    }
+}
+
+// 只有服务器故障按惩罚延迟计入, 服务端错误按实际延迟, 取消的调用不计入
+func TestWeightedLatencyErrorSamples(t *testing.T) {
+    s := newWeightedLatencySelector(KVPairs{{Key: "a"}}).(*weightedLatencySelector)
+    s.OnCallDone("a", 10*time.Millisecond, nil)
+    s.OnCallDone("a", 10*time.Millisecond, common.ServiceError("player not found"))
+    s.OnCallDone("a", time.Millisecond, context.Canceled)
+    if latency := time.Duration(s.latency["a"]); latency != 10*time.Millisecond {
+        t.Fatalf("latency = %v", latency)
+    }
+    s.OnCallDone("a", 10*time.Millisecond, common.ErrorConnectionClosed)
+    if latency := time.Duration(s.latency["a"]); latency < 300*time.Millisecond {
+        t.Fatalf("latency after failure = %v", latency)
+    }
+}
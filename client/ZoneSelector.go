@@ -0,0 +1,89 @@
+package client
+
+import (
+    "context"
+    "sync"
+    "time"
+)
+
+// zoneSelector filters servers by group and prefers servers in the local zone.
+// 是否可用由健康检查和熔断决定, 它们去掉的服务器不会传到这里
+type zoneSelector struct {
+    zone     string
+    groups   []string
+    mutex    sync.RWMutex
+    local    Selector // 本 zone 的服务器
+    remote   Selector // 其他 zone 的服务器
+    hasLocal bool
+}
+
+// zone 为空时所有服务器都视为本 zone
+func newZoneSelector(selectMode SelectMode, zone string, groups []string, servers KVPairs) Selector {
+    s := &zoneSelector{
+        zone:   zone,
+        groups: groups,
+        local:  newSelector(selectMode, nil),
+        remote: newSelector(selectMode, nil),
+    }
+    s.UpdateServer(servers)
+    return s
+}
+
+func (s *zoneSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+    if s.hasLocal {
+        return s.local.Select(ctx, servicePath, serviceMethod, args)
+    }
+    return s.remote.Select(ctx, servicePath, serviceMethod, args)
+}
+
+// groups 为空时不过滤
+func inGroups(kv KVPair, groups []string) bool {
+    if len(groups) == 0 {
+        return true
+    }
+    group := kv.Metadata().Get(MetaGroup)
+    for _, v := range groups {
+        if v == group {
+            return true
+        }
+    }
+    return false
+}
+
+// 按 group 过滤后按 zone 划分
+func (s *zoneSelector) UpdateServer(servers KVPairs) {
+    var local, remote KVPairs
+    for _, kv := range servers {
+        if !inGroups(kv, s.groups) {
+            continue
+        }
+        if s.zone == "" || kv.Metadata().Get(MetaZone) == s.zone {
+            local = append(local, kv)
+        } else {
+            remote = append(remote, kv)
+        }
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.local.UpdateServer(local)
+    s.remote.UpdateServer(remote)
+    s.hasLocal = len(local) > 0
+}
+
+func (s *zoneSelector) OnCallStart(server string) {
+    for _, selector := range []Selector{s.local, s.remote} {
+        if observer, ok := selector.(CallObserver); ok {
+            observer.OnCallStart(server)
+        }
+    }
+}
+
+func (s *zoneSelector) OnCallDone(server string, latency time.Duration, err error) {
+    for _, selector := range []Selector{s.local, s.remote} {
+        if observer, ok := selector.(CallObserver); ok {
+            observer.OnCallDone(server, latency, err)
+        }
+    }
+}
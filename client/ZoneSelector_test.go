@@ -0,0 +1,51 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestZoneSelectorPrefersLocalZone(t *testing.T) {
+    servers := KVPairs{
+        {Key: "a1", Value: "zone=a&group=stable"},
+        {Key: "a2", Value: "zone=a&group=canary"},
+        {Key: "b1", Value: "zone=b&group=stable"},
+    }
+    s := newZoneSelector(RoundRobin, "a", []string{"stable"}, servers)
+    for i := 0; i < 3; i++ {
+        if got := s.Select(context.Background(), "game", "Login", nil); got != "a1" {
+            t.Fatalf("select = %s, want a1", got)
+        }
+    }
+    // 本 zone 没有服务器时选择其他 zone, group 不匹配的不选
+    s.UpdateServer(servers[1:])
+    if got := s.Select(context.Background(), "game", "Login", nil); got != "b1" {
+        t.Fatalf("select = %s, want b1", got)
+    }
+    s.UpdateServer(servers[1:2])
+    if got := s.Select(context.Background(), "game", "Login", nil); got != "" {
+        t.Fatalf("select = %s, want none", got)
+    }
+}
+
+// 熔断打开的本 zone 服务器不再被选中, 冷却后恢复
+func TestZoneSelectorWithBreaker(t *testing.T) {
+    servers := KVPairs{
+        {Key: "a1", Value: "zone=a"},
+        {Key: "b1", Value: "zone=b"},
+    }
+    option := BreakerOption{FailureThreshold: 1, CoolDown: 50 * time.Millisecond}
+    s := newBreakerSelector(newZoneSelector(RoundRobin, "a", nil, servers), option, nil, servers)
+    observer := s.(CallObserver)
+    observer.OnCallStart("a1")
+    observer.OnCallDone("a1", time.Millisecond, errors.New("connection reset"))
+    if got := s.Select(context.Background(), "game", "Login", nil); got != "b1" {
+        t.Fatalf("select = %s, want b1 while a1 is open", got)
+    }
+    time.Sleep(60 * time.Millisecond)
+    if got := s.Select(context.Background(), "game", "Login", nil); got != "a1" {
+        t.Fatalf("select = %s, want a1 after cool down", got)
+    }
+}
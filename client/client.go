@@ -2,77 +2,636 @@ package client
 
 import (
     "context"
+    "errors"
+    "github.com/DGHeroin/rpc.go"
     "github.com/DGHeroin/rpc.go/common"
-    "golang.org/x/sync/singleflight"
+    "github.com/DGHeroin/rpc.go/kcp"
     "log"
+    "net"
     "strings"
+    "sync"
+    "time"
 )
 
 type (
+    FailMode int
     Option struct {
-        Retries    int
-        SelectMode SelectMode
+        Retries       int                // Failover 和 Failtry 失败后重试的次数
+        FailMode      FailMode
+        BackupLatency time.Duration      // Failbackup 发送第二个请求前的等待时间, 默认 10 毫秒
+        SelectMode    SelectMode
+        DialTimeout   time.Duration
+        Password      []byte             // kcp 加密, 与 Salt 同时设置时生效
+        Salt          []byte
+        ClientOption  rpc.ClientOption
+        Codec         common.Codec       // 参数和返回值的编码, 默认 JSON
+        Zone          string             // 优先选择元数据中 zone 相同的服务器, 本 zone 都不可用(见 HealthCheck 和 Breaker)时才选择其他 zone
+        Groups        []string           // 只选择元数据中 group 属于其中的服务器, 为空时不过滤
+        Breaker       *BreakerOption     // 每个服务器的熔断设置, 为 nil 时不熔断
+        HealthCheck   *HealthCheckOption // 主动健康检查, 为 nil 时不检查
+        PoolSize      int                // 每个地址的最大链接数, 默认 1
+        IdleTimeout   time.Duration      // 链接空闲超过该时间后关闭, 0 为不关闭
+        RateLimit     *RateLimitOption   // 调用方的限流, 为 nil 时不限制
     }
     Client interface {
         Call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error
+        // 异步调用, 结束时 call 被发送到 done
+        Go(ctx context.Context, serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call
+        // 调用所有服务器(按 Groups 和健康检查过滤, 见 callAll), 任一失败时返回错误
+        Broadcast(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error
+        // 调用所有服务器(同 Broadcast), 返回第一个成功的结果
+        Fork(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error
+        // 需在调用前添加, 如 CircuitBreakerPlugin
+        AddPlugin(p interface{})
+        Close() error
     }
     RPCClient interface {
+        Call(ctx context.Context, servicePath string, serviceMethod string, payload []byte) ([]byte, error)
+        Ping(ctx context.Context) (time.Duration, error)
+        WatchHealth(ctx context.Context, servicePath string, known rpc.HealthStatus) (rpc.HealthStatus, error)
+        Request(data []byte, cb func(*common.Message)) error
+        Push(data []byte) error
+        Close()
+    }
+    // Selector 实现该接口时, xClient 在每次调用开始和结束时通知, 用于统计延迟和并发
+    CallObserver interface {
+        OnCallStart(server string)
+        OnCallDone(server string, latency time.Duration, err error)
     }
     xClient struct {
         servicePath  string
+        option       Option
+        discovery    Discovery
+        mutex        sync.RWMutex
         selector     Selector
+        pairs        KVPairs // discovery 返回的服务器
+        servers      map[string]string
+        failures     map[string]int  // 健康检查连续失败的次数
+        unhealthy    map[string]bool // 不参与选择的服务器
+        notServing   map[string]bool // 健康服务报告 NOT_SERVING 的服务器
+        watching     map[string]bool // 正在 Watch 健康服务的服务器
         Plugins      common.PluginContainer
-        cachedClient map[string]RPCClient
-        sfGroup      singleflight.Group
+        cachedClient map[string]*connPool
+        exitCh       chan struct{}
+        closeOnce    sync.Once
+        limiter      *rateLimiter
+        eventMutex   sync.Mutex
+        events       []circuitEvent // 等待通知插件的熔断状态变化
+        eventCh      chan struct{}  // 有新的 events 时通知 eventLoop
+    }
+    // 异步调用, 同 net/rpc.Call, 结束时被发送到 Done
+    Call struct {
+        ServiceMethod string
+        Args          interface{}
+        Reply         interface{}
+        Error         error
+        Done          chan *Call
+    }
+    callResult struct {
+        data []byte
+        err  error
     }
 )
 
+const (
+    Failfast   FailMode = iota // 直接返回第一次的错误
+    Failover                   // 重新选择服务器重试
+    Failtry                    // 在同一台服务器重试
+    Failbackup                 // 等待 BackupLatency 后向另一台服务器发送相同的请求, 取先成功的结果
+)
+
+const defaultBackupLatency = 10 * time.Millisecond
+
 var (
     DefaultOption = Option{
-        Retries: 3,
+        Retries:  3,
+        FailMode: Failover,
     }
+    ErrorServerNotFound       = errors.New("server not found")
+    ErrorServerAddressInvalid = errors.New("server address invalid")
 )
 
 func NewClient(servicePath string, discovery Discovery, option Option) Client {
     client := &xClient{
         servicePath:  servicePath,
-        cachedClient: make(map[string]RPCClient),
+        option:       option,
+        discovery:    discovery,
+        cachedClient: make(map[string]*connPool),
+        failures:     make(map[string]int),
+        unhealthy:    make(map[string]bool),
+        notServing:   make(map[string]bool),
+        watching:     make(map[string]bool),
+        exitCh:       make(chan struct{}),
+        eventCh:      make(chan struct{}, 1),
+    }
+    if option.Breaker != nil {
+        go client.eventLoop()
+    }
+    if option.RateLimit != nil {
+        client.limiter = newRateLimiter(*option.RateLimit)
+    }
+    client.setServers(discovery.GetServices())
+    if ch := discovery.WatchServices(); ch != nil {
+        go client.watch(ch)
+    }
+    if option.HealthCheck != nil {
+        go client.healthCheckLoop(*option.HealthCheck)
+    }
+    if option.IdleTimeout > 0 {
+        go client.reapLoop(option.IdleTimeout)
     }
-    servers := discovery.GetServices().Keys()
-    client.selector = newSelector(option.SelectMode, servers)
     return client
 }
 
+// 只有可重试的错误才会按 FailMode 重试, 见 isRetryable, 重试不计入限流
 func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
-    addr, cli, err := c.selectClient(ctx, serviceMethod, args)
+    release, err := c.acquire(ctx, serviceMethod)
     if err != nil {
         return err
     }
-    log.Println(addr, cli)
-    return nil
+    defer release()
+    codec := c.codec()
+    payload, err := codec.Encode(args)
+    if err != nil {
+        return err
+    }
+    var data []byte
+    switch c.option.FailMode {
+    case Failover:
+        data, err = c.failover(ctx, serviceMethod, args, payload)
+    case Failtry:
+        data, err = c.failtry(ctx, serviceMethod, args, payload)
+    case Failbackup:
+        data, err = c.failbackup(ctx, serviceMethod, args, payload)
+    default:
+        var addr string
+        if addr, err = c.selectServer(ctx, serviceMethod, args); err == nil {
+            data, err = c.invoke(ctx, addr, serviceMethod, payload)
+        }
+    }
+    if err != nil {
+        return err
+    }
+    return codec.Decode(data, reply)
 }
 
-func (c *xClient) selectClient(ctx context.Context, serviceMethod string, args interface{}) (string, RPCClient, error) {
+func (c *xClient) failover(ctx context.Context, serviceMethod string, args interface{}, payload []byte) ([]byte, error) {
     var (
-        ok     bool
-        client RPCClient
+        data []byte
+        err  error
     )
-    selectedAddr := c.selector.Select(ctx, c.servicePath, serviceMethod, args)
-    client, ok = c.cachedClient[selectedAddr]
-    if !ok {
-        network, addr := splitNetworkAndAddress(selectedAddr)
-        log.Println(network, addr)
-        c.sfGroup.Do(selectedAddr, func() (interface{}, error) {
-            return c.connectTo(network, addr)
+    for retries := c.option.Retries; retries >= 0; retries-- {
+        var addr string
+        if addr, err = c.selectServer(ctx, serviceMethod, args); err != nil {
+            return nil, err
+        }
+        data, err = c.invoke(ctx, addr, serviceMethod, payload)
+        if err == nil || !isRetryable(ctx, err) {
+            return data, err
+        }
+    }
+    return nil, err
+}
+
+func (c *xClient) failtry(ctx context.Context, serviceMethod string, args interface{}, payload []byte) ([]byte, error) {
+    addr, err := c.selectServer(ctx, serviceMethod, args)
+    if err != nil {
+        return nil, err
+    }
+    var data []byte
+    for retries := c.option.Retries; retries >= 0; retries-- {
+        data, err = c.invoke(ctx, addr, serviceMethod, payload)
+        if err == nil || !isRetryable(ctx, err) {
+            return data, err
+        }
+    }
+    return nil, err
+}
+
+// 第一个请求失败时立即发送第二个, 选不到另一台服务器时不发送
+func (c *xClient) failbackup(ctx context.Context, serviceMethod string, args interface{}, payload []byte) ([]byte, error) {
+    addr, err := c.selectServer(ctx, serviceMethod, args)
+    if err != nil {
+        return nil, err
+    }
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    ch := make(chan callResult, 2)
+    send := func(addr string) {
+        go func() {
+            data, err := c.invoke(ctx, addr, serviceMethod, payload)
+            ch <- callResult{data: data, err: err}
+        }()
+    }
+    send(addr)
+    pending, backupSent := 1, false
+    sendBackup := func() {
+        backupSent = true
+        for i := 0; i < 3; i++ {
+            backup, err := c.selectServer(ctx, serviceMethod, args)
+            if err != nil {
+                return
+            }
+            if backup != addr {
+                send(backup)
+                pending++
+                return
+            }
+        }
+    }
+    latency := c.option.BackupLatency
+    if latency <= 0 {
+        latency = defaultBackupLatency
+    }
+    timer := time.NewTimer(latency)
+    defer timer.Stop()
+    for {
+        select {
+        case r := <-ch:
+            pending--
+            if r.err == nil || !isRetryable(ctx, r.err) {
+                return r.data, r.err
+            }
+            if !backupSent {
+                sendBackup()
+            }
+            if pending == 0 {
+                return nil, r.err
+            }
+        case <-timer.C:
+            if !backupSent {
+                sendBackup()
+            }
+        }
+    }
+}
+
+// done 为 nil 时新建, 否则必须带缓冲, 同 net/rpc.Client.Go
+func (c *xClient) Go(ctx context.Context, serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
+    if done == nil {
+        done = make(chan *Call, 10)
+    } else if cap(done) == 0 {
+        log.Panic("rpc: done channel is unbuffered")
+    }
+    call := &Call{
+        ServiceMethod: serviceMethod,
+        Args:          args,
+        Reply:         reply,
+        Done:          done,
+    }
+    go func() {
+        call.Error = c.Call(ctx, serviceMethod, args, reply)
+        select {
+        case call.Done <- call:
+        default:
+            log.Println("rpc: discarding Call reply due to insufficient Done chan capacity")
+        }
+    }()
+    return call
+}
+
+// 所有服务器都执行完后返回, reply 为其中一个服务器的结果
+func (c *xClient) Broadcast(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+    release, err := c.acquire(ctx, serviceMethod)
+    if err != nil {
+        return err
+    }
+    defer release()
+    codec := c.codec()
+    payload, err := codec.Encode(args)
+    if err != nil {
+        return err
+    }
+    ch, n, err := c.callAll(ctx, serviceMethod, payload)
+    if err != nil {
+        return err
+    }
+    var data []byte
+    for i := 0; i < n; i++ {
+        select {
+        case r := <-ch:
+            if r.err != nil && err == nil {
+                err = r.err
+            }
+            if r.err == nil && data == nil {
+                data = r.data
+            }
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+    if err != nil {
+        return err
+    }
+    return codec.Decode(data, reply)
+}
+
+// 收到第一个成功的结果后取消其他调用, 都失败时返回最后一个错误
+func (c *xClient) Fork(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+    release, err := c.acquire(ctx, serviceMethod)
+    if err != nil {
+        return err
+    }
+    defer release()
+    codec := c.codec()
+    payload, err := codec.Encode(args)
+    if err != nil {
+        return err
+    }
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    ch, n, err := c.callAll(ctx, serviceMethod, payload)
+    if err != nil {
+        return err
+    }
+    for i := 0; i < n; i++ {
+        select {
+        case r := <-ch:
+            if r.err == nil {
+                return codec.Decode(r.data, reply)
+            }
+            err = r.err
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+    return err
+}
+
+// 并发调用所有服务器, 返回接收结果的 channel 和服务器数量
+// 与 selector 一样去掉 Groups 之外和健康检查失败的服务器; 不按 Zone 优先, 也不跳过熔断打开的服务器,
+// Broadcast 对它们的调用失败时返回错误, 不会静默漏掉
+func (c *xClient) callAll(ctx context.Context, serviceMethod string, payload []byte) (<-chan callResult, int, error) {
+    c.mutex.RLock()
+    var servers []string
+    for _, kv := range c.healthyPairs() {
+        if inGroups(kv, c.option.Groups) {
+            servers = append(servers, kv.Key)
+        }
+    }
+    c.mutex.RUnlock()
+    if len(servers) == 0 {
+        return nil, 0, ErrorServerNotFound
+    }
+    ch := make(chan callResult, len(servers))
+    for _, addr := range servers {
+        go func(addr string) {
+            data, err := c.invoke(ctx, addr, serviceMethod, payload)
+            ch <- callResult{data: data, err: err}
+        }(addr)
+    }
+    return ch, len(servers), nil
+}
+
+// 建立链接失败也通知 CallObserver, selector 可以据此避开该服务器
+func (c *xClient) invoke(ctx context.Context, addr string, serviceMethod string, payload []byte) ([]byte, error) {
+    c.mutex.RLock()
+    observer, _ := c.selector.(CallObserver)
+    c.mutex.RUnlock()
+    if observer != nil {
+        observer.OnCallStart(addr)
+    }
+    start := time.Now()
+    var data []byte
+    cli, err := c.getClient(addr)
+    if err == nil {
+        data, err = cli.Call(ctx, c.servicePath, serviceMethod, payload)
+    }
+    if observer != nil {
+        observer.OnCallDone(addr, time.Since(start), err)
+    }
+    return data, err
+}
+
+func (c *xClient) AddPlugin(p interface{}) {
+    c.Plugins.Add(p)
+}
+
+func (c *xClient) acquire(ctx context.Context, serviceMethod string) (func(), error) {
+    if c.limiter == nil {
+        return func() {}, nil
+    }
+    return c.limiter.acquire(ctx, c.servicePath+"/"+serviceMethod)
+}
+
+func (c *xClient) codec() common.Codec {
+    if c.option.Codec == nil {
+        return common.JSONCodec{}
+    }
+    return c.option.Codec
+}
+
+// 关闭所有缓存的链接, discovery 由创建者关闭
+func (c *xClient) Close() error {
+    c.closeOnce.Do(func() {
+        close(c.exitCh)
+    })
+    c.mutex.Lock()
+    clients := c.cachedClient
+    c.cachedClient = make(map[string]*connPool)
+    c.mutex.Unlock()
+    for _, cli := range clients {
+        cli.Close()
+    }
+    return nil
+}
+
+// 服务列表变化时更新 selector, 并关闭已移除服务器的链接
+func (c *xClient) watch(ch <-chan KVPairs) {
+    for pairs := range ch {
+        c.setServers(pairs)
+    }
+}
+
+func (c *xClient) setServers(pairs KVPairs) {
+    servers := pairs.ToMap()
+    var removed []*connPool
+    c.mutex.Lock()
+    c.pairs = pairs
+    c.servers = servers
+    for _, m := range []map[string]bool{c.unhealthy, c.notServing} {
+        for addr := range m {
+            if _, ok := servers[addr]; !ok {
+                delete(m, addr)
+            }
+        }
+    }
+    for addr := range c.failures {
+        if _, ok := servers[addr]; !ok {
+            delete(c.failures, addr)
+        }
+    }
+    c.updateSelector()
+    for addr, cli := range c.cachedClient {
+        if _, ok := servers[addr]; !ok {
+            delete(c.cachedClient, addr)
+            removed = append(removed, cli)
+        }
+    }
+    c.mutex.Unlock()
+    for _, cli := range removed {
+        go cli.Close()
+    }
+}
+
+func (c *xClient) selectServer(ctx context.Context, serviceMethod string, args interface{}) (string, error) {
+    c.mutex.RLock()
+    addr := c.selector.Select(ctx, c.servicePath, serviceMethod, args)
+    c.mutex.RUnlock()
+    if addr == "" {
+        return "", ErrorServerNotFound
+    }
+    return addr, nil
+}
+
+// 返回地址的链接池, 链接在调用时按需建立
+func (c *xClient) getClient(key string) (RPCClient, error) {
+    c.mutex.RLock()
+    pool, ok := c.cachedClient[key]
+    c.mutex.RUnlock()
+    if ok {
+        return pool, nil
+    }
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if _, ok = c.servers[key]; !ok {
+        return nil, ErrorServerNotFound
+    }
+    if pool, ok = c.cachedClient[key]; !ok {
+        network, addr := splitNetworkAndAddress(key)
+        pool = newConnPool(c.option.PoolSize, c.option.ClientOption, func(ctx context.Context) (net.Conn, error) {
+            return c.dial(ctx, network, addr)
         })
+        c.cachedClient[key] = pool
+    }
+    return pool, nil
+}
+
+// 定时关闭空闲的链接
+func (c *xClient) reapLoop(idleTimeout time.Duration) {
+    ticker := time.NewTicker(idleTimeout / 2)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-c.exitCh:
+            return
+        case <-ticker.C:
+            c.mutex.RLock()
+            pools := make([]*connPool, 0, len(c.cachedClient))
+            for _, pool := range c.cachedClient {
+                pools = append(pools, pool)
+            }
+            c.mutex.RUnlock()
+            for _, pool := range pools {
+                pool.reap(idleTimeout)
+            }
+        }
+    }
+}
+
+// 建立链接的时间受调用的 ctx 和 DialTimeout 限制, kcp 无需握手
+func (c *xClient) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+    switch network {
+    case "kcp":
+        return kcp.NewKCPDialer(addr, c.option.Password, c.option.Salt)
+    default:
+        dialer := net.Dialer{Timeout: c.option.DialTimeout}
+        return dialer.DialContext(ctx, network, addr)
+    }
+}
+
+// 服务端返回的错误和调用方取消的调用不算服务器故障
+func isServerFailure(err error) bool {
+    if err == nil {
+        return false
+    }
+    var serviceErr common.ServiceError
+    if errors.As(err, &serviceErr) {
+        return false
+    }
+    return !errors.Is(err, context.Canceled)
+}
+
+// 调用时需持有写锁
+func (c *xClient) updateSelector() {
+    pairs := c.healthyPairs()
+    if c.selector == nil {
+        c.selector = c.newSelector(pairs)
+    } else {
+        c.selector.UpdateServer(pairs)
+    }
+}
+
+// 去掉健康检查失败的服务器, 都不健康时仍使用全部服务器, 调用时需持有锁
+func (c *xClient) healthyPairs() KVPairs {
+    pairs := c.pairs
+    if len(c.unhealthy) == 0 && len(c.notServing) == 0 {
+        return pairs
+    }
+    healthy := make(KVPairs, 0, len(pairs))
+    for _, kv := range pairs {
+        if !c.unhealthy[kv.Key] && !c.notServing[kv.Key] {
+            healthy = append(healthy, kv)
+        }
+    }
+    if len(healthy) == 0 {
+        return pairs
+    }
+    return healthy
+}
+
+// 按 Option 组合 zone/group 过滤和熔断
+func (c *xClient) newSelector(pairs KVPairs) Selector {
+    var selector Selector
+    if c.option.Zone != "" || len(c.option.Groups) > 0 {
+        selector = newZoneSelector(c.option.SelectMode, c.option.Zone, c.option.Groups, pairs)
+    } else {
+        selector = newSelector(c.option.SelectMode, pairs)
+    }
+    if c.option.Breaker != nil {
+        selector = newBreakerSelector(selector, *c.option.Breaker, c.onCircuitStateChange, pairs)
+    }
+    return selector
+}
+
+// 熔断状态在持有 c.mutex 时变化, 放入队列由 eventLoop 通知插件, 插件中可以调用 xClient
+func (c *xClient) onCircuitStateChange(server string, from, to CircuitState) {
+    c.eventMutex.Lock()
+    c.events = append(c.events, circuitEvent{server: server, from: from, to: to})
+    c.eventMutex.Unlock()
+    select {
+    case c.eventCh <- struct{}{}:
+    default:
     }
+}
 
-    return selectedAddr, client, nil
+// 按发生的顺序通知 CircuitBreakerPlugin, 关闭后未通知的事件被丢弃
+func (c *xClient) eventLoop() {
+    for {
+        select {
+        case <-c.exitCh:
+            return
+        case <-c.eventCh:
+        }
+        c.eventMutex.Lock()
+        events := c.events
+        c.events = nil
+        c.eventMutex.Unlock()
+        for _, e := range events {
+            c.Plugins.Range(func(i interface{}) {
+                if p, ok := i.(CircuitBreakerPlugin); ok {
+                    p.OnCircuitStateChange(e.server, e.from, e.to)
+                }
+            })
+        }
+    }
 }
 
-func (c *xClient) connectTo(network string, addr string) (RPCClient, error) {
-    return nil, nil
+// 服务器故障可以重试, 服务端返回的错误和调用方取消或超时后不重试
+func isRetryable(ctx context.Context, err error) bool {
+    return ctx.Err() == nil && isServerFailure(err)
 }
+
 func splitNetworkAndAddress(server string) (string, string) {
     ss := strings.SplitN(server, "@", 2)
     if len(ss) == 1 {
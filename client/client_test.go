@@ -0,0 +1,242 @@
+package client
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/DGHeroin/rpc.go"
+    "github.com/DGHeroin/rpc.go/common"
+    "net"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// 启动一个服务器, Name 返回 name, Fail 返回服务端错误, calls 记录处理的调用数
+func startServer(t *testing.T, name string, delay time.Duration, calls *int32) string {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv, _ := rpc.NewServer(nil)
+    srv.Handle("game", "Name", func(sess *common.Session, payload []byte) ([]byte, error) {
+        if calls != nil {
+            atomic.AddInt32(calls, 1)
+        }
+        time.Sleep(delay)
+        return json.Marshal(name)
+    })
+    srv.Handle("game", "Fail", func(sess *common.Session, payload []byte) ([]byte, error) {
+        if calls != nil {
+            atomic.AddInt32(calls, 1)
+        }
+        return nil, errors.New("denied")
+    })
+    go func() { _ = srv.Serve(ln) }()
+    t.Cleanup(func() { _ = srv.Close() })
+    return ln.Addr().String()
+}
+
+// 没有监听的地址, 链接被拒绝
+func downServer(t *testing.T) string {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := ln.Addr().String()
+    _ = ln.Close()
+    return addr
+}
+
+func newTestClient(t *testing.T, mode FailMode, servers ...string) Client {
+    pairs := make(KVPairs, 0, len(servers))
+    for _, server := range servers {
+        pairs = append(pairs, KVPair{Key: server})
+    }
+    d, _ := NewMultipleServersDiscovery(pairs)
+    option := DefaultOption
+    option.SelectMode = RoundRobin
+    option.FailMode = mode
+    option.BackupLatency = 20 * time.Millisecond
+    c := NewClient("game", d, option)
+    t.Cleanup(func() {
+        _ = c.Close()
+        d.Close()
+    })
+    return c
+}
+
+func callName(c Client) (string, error) {
+    var name string
+    err := c.Call(context.Background(), "Name", nil, &name)
+    return name, err
+}
+
+func TestFailfast(t *testing.T) {
+    c := newTestClient(t, Failfast, downServer(t), startServer(t, "up", 0, nil))
+    if _, err := callName(c); err == nil {
+        t.Fatal("call to the down server succeeded")
+    }
+    if name, err := callName(c); err != nil || name != "up" {
+        t.Fatalf("second call = %q, %v", name, err)
+    }
+}
+
+func TestFailover(t *testing.T) {
+    c := newTestClient(t, Failover, downServer(t), startServer(t, "up", 0, nil))
+    for i := 0; i < 4; i++ {
+        if name, err := callName(c); err != nil || name != "up" {
+            t.Fatalf("call %d = %q, %v", i, name, err)
+        }
+    }
+
+    all := newTestClient(t, Failover, downServer(t), downServer(t))
+    if _, err := callName(all); err == nil {
+        t.Fatal("call succeeded with all servers down")
+    }
+}
+
+// 在同一台服务器重试, 不换服务器
+func TestFailtry(t *testing.T) {
+    c := newTestClient(t, Failtry, downServer(t), startServer(t, "up", 0, nil))
+    if _, err := callName(c); err == nil {
+        t.Fatal("failtry moved to another server")
+    }
+    if name, err := callName(c); err != nil || name != "up" {
+        t.Fatalf("second call = %q, %v", name, err)
+    }
+}
+
+// 第一台服务器慢时, 等待 BackupLatency 后发送到另一台, 取先返回的结果
+func TestFailbackup(t *testing.T) {
+    c := newTestClient(t, Failbackup, startServer(t, "slow", 300*time.Millisecond, nil), startServer(t, "fast", 0, nil))
+    start := time.Now()
+    name, err := callName(c)
+    if err != nil || name != "fast" {
+        t.Fatalf("call = %q, %v", name, err)
+    }
+    if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+        t.Fatalf("call took %v", elapsed)
+    }
+
+    // 第一个请求失败时立即发送第二个
+    c = newTestClient(t, Failbackup, downServer(t), startServer(t, "up", 0, nil))
+    if name, err := callName(c); err != nil || name != "up" {
+        t.Fatalf("call = %q, %v", name, err)
+    }
+}
+
+// 服务端返回的错误不重试
+func TestServiceErrorNotRetried(t *testing.T) {
+    for _, mode := range []FailMode{Failover, Failtry, Failbackup} {
+        var calls int32
+        c := newTestClient(t, mode, startServer(t, "a", 0, &calls), startServer(t, "b", 0, &calls))
+        err := c.Call(context.Background(), "Fail", nil, nil)
+        var serviceErr common.ServiceError
+        if !errors.As(err, &serviceErr) || serviceErr.Error() != "denied" {
+            t.Fatalf("mode %d err = %v", mode, err)
+        }
+        if n := atomic.LoadInt32(&calls); n != 1 {
+            t.Fatalf("mode %d handled %d calls, want 1", mode, n)
+        }
+    }
+}
+
+// 调用方取消后不重试
+func TestCanceledNotRetried(t *testing.T) {
+    var calls int32
+    c := newTestClient(t, Failover, startServer(t, "slow", 100*time.Millisecond, &calls), startServer(t, "b", 100*time.Millisecond, &calls))
+    ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    var name string
+    if err := c.Call(ctx, "Name", nil, &name); !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("err = %v", err)
+    }
+    time.Sleep(150 * time.Millisecond)
+    if n := atomic.LoadInt32(&calls); n != 1 {
+        t.Fatalf("handled %d calls, want 1", n)
+    }
+}
+
+// 在熔断状态变化时发起调用的插件
+type callingBreakerPlugin struct {
+    c      Client
+    events chan string
+}
+
+func (p *callingBreakerPlugin) OnCircuitStateChange(server string, from, to CircuitState) {
+    if to == CircuitHalfOpen {
+        _, err := callName(p.c)
+        p.events <- from.String() + "->" + to.String() + " call err=" + fmt.Sprint(err)
+        return
+    }
+    p.events <- from.String() + "->" + to.String()
+}
+
+// 插件在 discovery 更新引起的状态变化中调用 xClient 不会死锁
+func TestCircuitPluginCallsClient(t *testing.T) {
+    down, up := downServer(t), startServer(t, "up", 0, nil)
+    d, _ := NewMultipleServersDiscovery(KVPairs{{Key: down}, {Key: up}})
+    defer d.Close()
+    option := DefaultOption
+    option.SelectMode = RoundRobin
+    option.FailMode = Failfast
+    option.Breaker = &BreakerOption{FailureThreshold: 1, CoolDown: 50 * time.Millisecond}
+    c := NewClient("game", d, option)
+    defer c.Close()
+    p := &callingBreakerPlugin{c: c, events: make(chan string, 10)}
+    c.AddPlugin(p)
+
+    for i := 0; i < 2; i++ {
+        _, _ = callName(c)
+    }
+    time.Sleep(60 * time.Millisecond)
+    updated := make(chan struct{})
+    go func() {
+        _ = d.Update(KVPairs{{Key: down}, {Key: up}})
+        close(updated)
+    }()
+    select {
+    case <-updated:
+    case <-time.After(3 * time.Second):
+        t.Fatal("Update blocked")
+    }
+    var events []string
+    for len(events) < 2 {
+        select {
+        case e := <-p.events:
+            events = append(events, e)
+        case <-time.After(3 * time.Second):
+            t.Fatalf("events = %v", events)
+        }
+    }
+    if events[0] != "closed->open" || events[1] != "open->half-open call err=<nil>" {
+        t.Fatalf("events = %v", events)
+    }
+}
+
+// Broadcast 和 Fork 只调用 Groups 中的服务器
+func TestBroadcastHonorsGroups(t *testing.T) {
+    var canary, stable int32
+    d, _ := NewMultipleServersDiscovery(KVPairs{
+        {Key: startServer(t, "canary", 0, &canary), Value: "group=canary"},
+        {Key: startServer(t, "stable", 0, &stable), Value: "group=stable"},
+    })
+    defer d.Close()
+    option := DefaultOption
+    option.Groups = []string{"canary"}
+    c := NewClient("game", d, option)
+    defer c.Close()
+
+    var name string
+    if err := c.Broadcast(context.Background(), "Name", nil, &name); err != nil || name != "canary" {
+        t.Fatalf("Broadcast = %q, %v", name, err)
+    }
+    if err := c.Fork(context.Background(), "Name", nil, &name); err != nil || name != "canary" {
+        t.Fatalf("Fork = %q, %v", name, err)
+    }
+    if atomic.LoadInt32(&canary) != 2 || atomic.LoadInt32(&stable) != 0 {
+        t.Fatalf("canary = %d, stable = %d", canary, stable)
+    }
+}
@@ -1,16 +1,89 @@
 package client
 
+import (
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// KVPair.Value 中的元数据, 格式同 URL query: weight=10&zone=a&group=canary&state=inactive
+const (
+    MetaWeight = "weight"
+    MetaZone   = "zone"
+    MetaGroup  = "group"
+    MetaState  = "state"
+
+    StateInactive = "inactive"
+)
+
 type (
     Discovery interface {
         GetServices() KVPairs
+        // 每次调用返回一个新的 channel, 服务列表变化时推送完整列表, 不支持时返回 nil
+        WatchServices() <-chan KVPairs
+        // 停止推送并关闭所有 WatchServices 返回的 channel
+        Close()
     }
     KVPair struct {
-        Key   string
-        Value string
+        Key   string `json:"key"`
+        Value string `json:"value,omitempty"`
     }
     KVPairs []KVPair
+    // 管理 WatchServices 返回的 channel
+    serviceWatchers struct {
+        mutex  sync.Mutex
+        chans  []chan KVPairs
+        closed bool
+    }
 )
 
+// 解析 "tcp@127.0.0.1:9527?weight=10&zone=a" 形式的配置
+func ParseKVPair(s string) (KVPair, error) {
+    ss := strings.SplitN(s, "?", 2)
+    kv := KVPair{Key: ss[0]}
+    if len(ss) == 2 {
+        kv.Value = ss[1]
+    }
+    if _, err := url.ParseQuery(kv.Value); err != nil {
+        return kv, err
+    }
+    return kv, nil
+}
+
+// Value 中的元数据, 格式错误时返回空
+func (kv KVPair) Metadata() url.Values {
+    values, err := url.ParseQuery(kv.Value)
+    if err != nil {
+        return url.Values{}
+    }
+    return values
+}
+
+// 元数据中的 weight, 没有或不合法时为 1
+func (kv KVPair) Weight() int {
+    w, err := strconv.Atoi(kv.Metadata().Get(MetaWeight))
+    if err != nil || w <= 0 {
+        return 1
+    }
+    return w
+}
+
+func (kv KVPair) IsActive() bool {
+    return kv.Metadata().Get(MetaState) != StateInactive
+}
+
+// 去掉 state=inactive 的服务器
+func (kv KVPairs) Active() KVPairs {
+    result := make(KVPairs, 0, len(kv))
+    for _, v := range kv {
+        if v.IsActive() {
+            result = append(result, v)
+        }
+    }
+    return result
+}
+
 func (kv KVPairs) ToMap() map[string]string {
     result := make(map[string]string, len(kv))
     for _, v := range kv {
@@ -20,7 +93,7 @@ func (kv KVPairs) ToMap() map[string]string {
 }
 
 func (kv KVPairs) Keys() []string {
-    result := make([]string, len(kv))
+    result := make([]string, 0, len(kv))
     for _, v := range kv {
         result = append(result, v.Key)
     }
@@ -28,9 +101,54 @@ func (kv KVPairs) Keys() []string {
 }
 
 func (kv KVPairs) Values() []string {
-    result := make([]string, len(kv))
+    result := make([]string, 0, len(kv))
     for _, v := range kv {
         result = append(result, v.Value)
     }
     return result
 }
+
+func (w *serviceWatchers) watch() <-chan KVPairs {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    ch := make(chan KVPairs, 10)
+    if w.closed {
+        close(ch)
+        return ch
+    }
+    w.chans = append(w.chans, ch)
+    return ch
+}
+
+// 推送完整列表, 接收方来不及处理时丢弃最旧的一次
+func (w *serviceWatchers) notify(pairs KVPairs) {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    for _, ch := range w.chans {
+        for {
+            select {
+            case ch <- pairs:
+            default:
+                select {
+                case <-ch:
+                default:
+                }
+                continue
+            }
+            break
+        }
+    }
+}
+
+func (w *serviceWatchers) close() {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    if w.closed {
+        return
+    }
+    w.closed = true
+    for _, ch := range w.chans {
+        close(ch)
+    }
+    w.chans = nil
+}
@@ -0,0 +1,184 @@
+package rpc
+
+import (
+    "github.com/DGHeroin/rpc.go/common"
+    "net"
+    "testing"
+    "time"
+)
+
+type (
+    // 回显 Request, payload 为 "slow" 时延迟回复
+    echoPlugin struct {
+        accepted chan *common.Session
+        closed   chan *common.Session
+    }
+    // 记录客户端的关闭, 不回复服务器的请求
+    clientClosePlugin struct {
+        closed chan closeInfo
+    }
+)
+
+func (p *echoPlugin) OnAccept(sess *common.Session) { p.accepted <- sess }
+func (p *echoPlugin) OnClose(sess *common.Session)  { p.closed <- sess }
+func (p *echoPlugin) OnMessage(sess *common.Session, msg *common.Message) {
+    if string(msg.Payload) == "slow" {
+        time.Sleep(100 * time.Millisecond)
+    }
+    _ = msg.Reply(msg.Payload)
+}
+
+func (p *clientClosePlugin) OnClose(code uint32, reason string) {
+    p.closed <- closeInfo{code: code, reason: reason}
+}
+func (p *clientClosePlugin) OnMessage(msg *common.Message) {}
+
+// plugins 在服务器启动前加入
+func newClosePair(t *testing.T, plugins ...interface{}) (*Server, *echoPlugin, *common.Session, *Client, *clientClosePlugin) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv, _ := NewServer(nil)
+    sp := &echoPlugin{accepted: make(chan *common.Session, 1), closed: make(chan *common.Session, 1)}
+    for _, p := range plugins {
+        srv.AddPlugin(p)
+    }
+    srv.AddPlugin(sp)
+    go func() { _ = srv.Serve(ln) }()
+    t.Cleanup(func() { _ = srv.Close() })
+
+    conn, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    cli, _ := NewClient(nil)
+    cp := &clientClosePlugin{closed: make(chan closeInfo, 1)}
+    cli.AddPlugin(cp)
+    go func() { _ = cli.Serve(conn) }()
+    return srv, sp, <-sp.accepted, cli, cp
+}
+
+func waitMessage(t *testing.T, ch chan *common.Message) *common.Message {
+    select {
+    case msg := <-ch:
+        return msg
+    case <-time.After(3 * time.Second):
+        t.Fatal("timeout waiting for reply")
+        return nil
+    }
+}
+
+// 客户端关闭时, 服务器确认前会先写出已收到请求的回复
+func TestClientCloseDrainsReplies(t *testing.T) {
+    _, sp, _, cli, cp := newClosePair(t)
+    replies := make(chan *common.Message, 1)
+    if err := cli.Request([]byte("slow"), func(msg *common.Message) { replies <- msg }); err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(20 * time.Millisecond)
+    cli.Close()
+
+    msg := waitMessage(t, replies)
+    if msg.Err != nil || string(msg.Payload) != "slow" {
+        t.Fatalf("reply = %q, %v; want slow", msg.Payload, msg.Err)
+    }
+    select {
+    case info := <-cp.closed:
+        if info.code != common.CloseCodeNormal {
+            t.Fatalf("client close code = %d", info.code)
+        }
+    case <-time.After(3 * time.Second):
+        t.Fatal("client OnClose not called")
+    }
+    select {
+    case sess := <-sp.closed:
+        if sess.CloseCode() != common.CloseCodeNormal {
+            t.Fatalf("server close code = %d", sess.CloseCode())
+        }
+    case <-time.After(3 * time.Second):
+        t.Fatal("server OnClose not called")
+    }
+}
+
+// 服务器踢掉链接时, 客户端收到原因, 未回复的请求以 ErrorClosedByPeer 结束
+func TestKickFailsPendingWithClosedByPeer(t *testing.T) {
+    srv, _, sess, cli, cp := newClosePair(t)
+    replies := make(chan *common.Message, 1)
+    if err := cli.Request([]byte("slow"), func(msg *common.Message) { replies <- msg }); err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(20 * time.Millisecond)
+    if err := srv.Kick(sess.ID(), common.CloseCodeUser, "logged in elsewhere"); err != nil {
+        t.Fatal(err)
+    }
+
+    if msg := waitMessage(t, replies); msg.Err != common.ErrorClosedByPeer {
+        t.Fatalf("pending request err = %v, want %v", msg.Err, common.ErrorClosedByPeer)
+    }
+    select {
+    case info := <-cp.closed:
+        if info.code != common.CloseCodeUser || info.reason != "logged in elsewhere" {
+            t.Fatalf("client close = %d %q", info.code, info.reason)
+        }
+    case <-time.After(3 * time.Second):
+        t.Fatal("client OnClose not called")
+    }
+    if code, reason := cli.CloseReason(); code != common.CloseCodeUser || reason != "logged in elsewhere" {
+        t.Fatalf("CloseReason = %d %q", code, reason)
+    }
+}
+
+// 服务器对未回复的请求在关闭握手后以 ErrorConnectionClosed 结束
+func TestKickFailsServerPending(t *testing.T) {
+    srv, _, sess, _, _ := newClosePair(t)
+    replies := make(chan *common.Message, 1)
+    if _, err := srv.Request(sess.ID(), 0, []byte("x"), func(msg *common.Message) { replies <- msg }); err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Kick(sess.ID(), common.CloseCodeUser, "maintenance"); err != nil {
+        t.Fatal(err)
+    }
+    if msg := waitMessage(t, replies); msg.Err != common.ErrorConnectionClosed {
+        t.Fatalf("pending request err = %v, want %v", msg.Err, common.ErrorConnectionClosed)
+    }
+    if sess.CloseCode() != common.CloseCodeUser || sess.CloseReason() != "maintenance" {
+        t.Fatalf("session close = %d %q", sess.CloseCode(), sess.CloseReason())
+    }
+}
+
+// 对端不读取数据时写出超时, 以 CloseCodeError 关闭
+func TestWriteTimeoutClosesWithError(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv, _ := NewServer(&ServerOption{WriteTimeout: 50 * time.Millisecond})
+    sp := &echoPlugin{accepted: make(chan *common.Session, 1), closed: make(chan *common.Session, 1)}
+    srv.AddPlugin(sp)
+    go func() { _ = srv.Serve(ln) }()
+    t.Cleanup(func() { _ = srv.Close() })
+
+    conn, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    sess := <-sp.accepted
+    data := make([]byte, 1024*1024)
+    go func() {
+        for {
+            if _, err := srv.Push(sess.ID(), 0, data); err != nil {
+                return
+            }
+        }
+    }()
+    select {
+    case sess := <-sp.closed:
+        if sess.CloseCode() != common.CloseCodeError {
+            t.Fatalf("close code = %d %q", sess.CloseCode(), sess.CloseReason())
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("server OnClose not called")
+    }
+}
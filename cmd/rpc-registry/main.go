@@ -0,0 +1,60 @@
+package main
+
+import (
+    "flag"
+    "github.com/DGHeroin/rpc.go"
+    "github.com/DGHeroin/rpc.go/kcp"
+    "github.com/DGHeroin/rpc.go/registry"
+    "log"
+    "net"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+)
+
+var (
+    address  = flag.String("addr", ":9500", "listen address")
+    network  = flag.String("network", "tcp", "tcp or kcp")
+    password = flag.String("password", "", "kcp password, used with salt; clients pass the same in registry.DialOption")
+    salt     = flag.String("salt", "", "kcp salt")
+    ttl      = flag.Duration("ttl", registry.DefaultTTL, "registration ttl")
+)
+
+func main() {
+    log.SetFlags(log.LstdFlags | log.Lshortfile)
+    flag.Parse()
+    server, err := registry.NewServer(*ttl, &rpc.ServerOption{
+        ReadTimeout:  time.Minute,
+        WriteTimeout: time.Second * 10,
+        PingInterval: time.Second * 10,
+    })
+    if err != nil {
+        log.Fatal(err)
+    }
+    ln, err := listen()
+    if err != nil {
+        log.Fatal(err)
+    }
+    go func() {
+        ch := make(chan os.Signal, 1)
+        signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+        <-ch
+        _ = server.Close()
+    }()
+    log.Println("registry listen on", *network, ln.Addr())
+    if err := server.Serve(ln); err != nil {
+        log.Fatal(err)
+    }
+}
+
+func listen() (net.Listener, error) {
+    if *network == "kcp" {
+        var p, s []byte
+        if *password != "" && *salt != "" {
+            p, s = []byte(*password), []byte(*salt)
+        }
+        return kcp.NewKCPListenerServe(*address, p, s)
+    }
+    return net.Listen("tcp", *address)
+}
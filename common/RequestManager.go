@@ -9,40 +9,78 @@ type RequestManager struct {
     mutex      sync.Mutex
     requestId  uint32
     requestMap map[uint32]func(*Message)
+    cancelled  map[uint32]struct{} // 已取消的请求, 之后到达的回复直接丢弃
 }
 
+// 收到 MessageTypeResponse 或 MessageTypeError, 后者设置 msg.Err
 func (m *RequestManager) OnReply(msg *Message) {
+    if msg.Type == MessageTypeError && msg.Err == nil {
+        msg.Err = ServiceError(msg.Payload)
+    }
     id := msg.RequestId
     m.mutex.Lock()
     cb, ok := m.requestMap[id]
+    delete(m.requestMap, id)
+    _, cancelled := m.cancelled[id]
+    delete(m.cancelled, id)
     m.mutex.Unlock()
     if !ok {
-        log.Println("不存在", id)
+        if !cancelled {
+            log.Println("不存在", id)
+        }
         return
     }
     cb(msg)
 }
 
 func (c *RequestManager) NextRequestId(cb func(*Message)) uint32 {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
     for {
         if c.requestId == 0 {
             c.requestId++
         }
-        c.mutex.Lock()
-        _, ok := c.requestMap[c.requestId]
-        c.mutex.Unlock()
-        if !ok {
-            c.mutex.Lock()
-            c.requestMap[c.requestId] = cb
-            c.mutex.Unlock()
-            return c.requestId
-        }
+        id := c.requestId
         c.requestId++
+        if _, ok := c.requestMap[id]; !ok {
+            c.requestMap[id] = cb
+            delete(c.cancelled, id)
+            return id
+        }
+    }
+}
+
+// 取消一个请求, 回调不会被调用, 返回 false 表示回调已被调用或正在调用
+func (c *RequestManager) Remove(id uint32) bool {
+    c.mutex.Lock()
+    _, ok := c.requestMap[id]
+    if ok {
+        delete(c.requestMap, id)
+        c.cancelled[id] = struct{}{}
+    }
+    c.mutex.Unlock()
+    return ok
+}
+
+// 以 err 结束所有未回复的请求
+func (c *RequestManager) CloseAll(err error) {
+    c.mutex.Lock()
+    requestMap := c.requestMap
+    c.requestMap = map[uint32]func(*Message){}
+    c.cancelled = map[uint32]struct{}{}
+    c.mutex.Unlock()
+    for id, cb := range requestMap {
+        cb(&Message{
+            Type:      MessageTypeResponse,
+            RequestId: id,
+            Err:       err,
+        })
     }
 }
 func NewRequestManager() *RequestManager {
     return &RequestManager{
         requestId:  0,
         requestMap: map[uint32]func(*Message){},
+        cancelled:  map[uint32]struct{}{},
     }
 }
@@ -0,0 +1,41 @@
+package common
+
+import (
+    "bytes"
+    "log"
+    "os"
+    "testing"
+)
+
+// 取消的请求的回复到达时不调用回调, 也不输出日志
+func TestRequestManagerCancelledReply(t *testing.T) {
+    var buf bytes.Buffer
+    log.SetOutput(&buf)
+    defer log.SetOutput(os.Stderr)
+
+    m := NewRequestManager()
+    called := 0
+    id := m.NextRequestId(func(*Message) { called++ })
+    if !m.Remove(id) {
+        t.Fatal("Remove returned false for a pending request")
+    }
+    if m.Remove(id) {
+        t.Fatal("Remove returned true twice")
+    }
+    m.OnReply(&Message{Type: MessageTypeResponse, RequestId: id})
+    if called != 0 || buf.Len() != 0 {
+        t.Fatalf("called = %d, log = %q", called, buf.String())
+    }
+
+    // 未知的回复仍然输出日志
+    m.OnReply(&Message{Type: MessageTypeResponse, RequestId: id})
+    if buf.Len() == 0 {
+        t.Fatal("unknown reply not logged")
+    }
+
+    id = m.NextRequestId(func(*Message) { called++ })
+    m.OnReply(&Message{Type: MessageTypeResponse, RequestId: id})
+    if called != 1 {
+        t.Fatalf("called = %d", called)
+    }
+}
@@ -0,0 +1,116 @@
+package common
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+)
+
+type (
+    // 服务端返回的错误, 由处理函数产生, 与链接无关
+    ServiceError string
+    // 参数和返回值的编码方式
+    Codec interface {
+        Encode(v interface{}) ([]byte, error)
+        Decode(data []byte, v interface{}) error
+    }
+    // JSON 编码, []byte 和 *[]byte 原样传递
+    JSONCodec struct{}
+)
+
+func (e ServiceError) Error() string {
+    return string(e)
+}
+
+func (JSONCodec) Encode(v interface{}) ([]byte, error) {
+    if data, ok := v.([]byte); ok {
+        return data, nil
+    }
+    return json.Marshal(v)
+}
+
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+    if p, ok := v.(*[]byte); ok {
+        *p = append((*p)[:0], data...)
+        return nil
+    }
+    if v == nil || len(data) == 0 {
+        return nil
+    }
+    return json.Unmarshal(data, v)
+}
+
+// Call 消息的内容: servicePath 长度(2) + servicePath + serviceMethod 长度(2) + serviceMethod + payload
+func EncodeCall(servicePath string, serviceMethod string, payload []byte) []byte {
+    buffer := bytes.NewBuffer(nil)
+    writeString16(servicePath, buffer)
+    writeString16(serviceMethod, buffer)
+    buffer.Write(payload)
+    return buffer.Bytes()
+}
+
+func DecodeCall(data []byte) (servicePath string, serviceMethod string, payload []byte, err error) {
+    if servicePath, data, err = readString16(data); err != nil {
+        return
+    }
+    if serviceMethod, data, err = readString16(data); err != nil {
+        return
+    }
+    return servicePath, serviceMethod, data, nil
+}
+
+// Call 回复的状态
+const (
+    CallStatusOK    = uint8(0)
+    CallStatusError = uint8(1)
+)
+
+// Call 回复的内容: 状态(1) + payload, 状态为 CallStatusError 时之后为错误信息
+func EncodeCallReply(payload []byte) []byte {
+    data := make([]byte, 1+len(payload))
+    data[0] = CallStatusOK
+    copy(data[1:], payload)
+    return data
+}
+
+func EncodeCallError(err error) []byte {
+    msg := err.Error()
+    data := make([]byte, 1+len(msg))
+    data[0] = CallStatusError
+    copy(data[1:], msg)
+    return data
+}
+
+// 服务端返回错误时 err 为 ServiceError, 错误信息可以为空
+func DecodeCallReply(data []byte) ([]byte, error) {
+    if len(data) < 1 {
+        return nil, ErrorMessageFormatInvalid
+    }
+    switch data[0] {
+    case CallStatusOK:
+        return data[1:], nil
+    case CallStatusError:
+        return nil, ServiceError(data[1:])
+    default:
+        return nil, ErrorMessageFormatInvalid
+    }
+}
+
+func writeString16(s string, buffer *bytes.Buffer) {
+    data := make([]byte, 2)
+    binary.BigEndian.PutUint16(data, uint16(len(s)))
+    buffer.Write(data)
+    buffer.WriteString(s)
+}
+
+func readString16(data []byte) (string, []byte, error) {
+    if len(data) < 2 {
+        return "", nil, ErrorMessageFormatInvalid
+    }
+    size := int(binary.BigEndian.Uint16(data))
+    data = data[2:]
+    if len(data) < size {
+        return "", nil, ErrorMessageFormatInvalid
+    }
+    return string(data[:size]), data[size:], nil
+}
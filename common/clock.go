@@ -0,0 +1,87 @@
+package common
+
+import (
+    "sync"
+    "time"
+)
+
+const DefaultClockSyncSamples = 8
+
+type (
+    // 根据 ping/pong 估算与对端的时钟差, 取最近若干次中 RTT 最小的一次
+    ClockSync struct {
+        mutex   sync.Mutex
+        size    int
+        samples []clockSample
+        next    int
+    }
+    clockSample struct {
+        offset time.Duration
+        rtt    time.Duration
+    }
+)
+
+func NewClockSync(size int) *ClockSync {
+    if size <= 0 {
+        size = DefaultClockSyncSamples
+    }
+    return &ClockSync{size: size}
+}
+
+// 收到 pong: 假设往返对称, 对端时间对应本端 ping 发出和收到的中点
+// rtt 为本端按单调时钟测得的往返时间, SendTime 只用于计算时钟差
+func (c *ClockSync) OnPong(k *KeepAlive, rtt time.Duration) {
+    if rtt < 0 || k.PeerTime == 0 {
+        return
+    }
+    sample := clockSample{
+        offset: time.Duration(k.PeerTime-k.SendTime) - rtt/2,
+        rtt:    rtt,
+    }
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if len(c.samples) < c.size {
+        c.samples = append(c.samples, sample)
+        return
+    }
+    c.samples[c.next] = sample
+    c.next = (c.next + 1) % c.size
+}
+
+func (c *ClockSync) best() (clockSample, bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if len(c.samples) == 0 {
+        return clockSample{}, false
+    }
+    best := c.samples[0]
+    for _, v := range c.samples[1:] {
+        if v.rtt < best.rtt {
+            best = v
+        }
+    }
+    return best, true
+}
+
+// 对端时间减去本端时间
+func (c *ClockSync) Offset() time.Duration {
+    sample, _ := c.best()
+    return sample.offset
+}
+
+// 时钟差的最大误差, 为所选样本 RTT 的一半
+func (c *ClockSync) Error() time.Duration {
+    sample, _ := c.best()
+    return sample.rtt / 2
+}
+
+// 是否已经有样本
+func (c *ClockSync) Ready() bool {
+    _, ok := c.best()
+    return ok
+}
+
+// 按时钟差换算出的对端当前时间
+func (c *ClockSync) PeerTime() time.Time {
+    return time.Now().Add(c.Offset())
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+    "testing"
+    "time"
+)
+
+// 取窗口内 RTT 最小的样本, 旧样本被新样本替换
+func TestClockSyncBestSample(t *testing.T) {
+    c := NewClockSync(3)
+    if c.Ready() {
+        t.Fatal("ready without samples")
+    }
+    send := int64(1000 * time.Millisecond)
+    pong := func(offset, rtt time.Duration) {
+        c.OnPong(&KeepAlive{Pong: true, SendTime: send, PeerTime: send + int64(rtt/2+offset)}, rtt)
+    }
+    pong(50*time.Millisecond, 40*time.Millisecond)
+    pong(10*time.Millisecond, 4*time.Millisecond)
+    pong(90*time.Millisecond, 80*time.Millisecond)
+    if c.Offset() != 10*time.Millisecond || c.Error() != 2*time.Millisecond {
+        t.Fatalf("offset = %v, error = %v", c.Offset(), c.Error())
+    }
+    // 窗口为 3, 替换掉最早的样本后最好的仍然保留
+    pong(70*time.Millisecond, 60*time.Millisecond)
+    if c.Offset() != 10*time.Millisecond {
+        t.Fatalf("offset = %v", c.Offset())
+    }
+    // 再替换掉最好的样本
+    pong(30*time.Millisecond, 20*time.Millisecond)
+    if c.Offset() != 30*time.Millisecond || c.Error() != 10*time.Millisecond {
+        t.Fatalf("offset = %v, error = %v", c.Offset(), c.Error())
+    }
+
+    // 没有对端时间的 pong 和负的 rtt 不计入
+    c.OnPong(&KeepAlive{Pong: true, SendTime: send}, time.Millisecond)
+    c.OnPong(&KeepAlive{Pong: true, SendTime: send, PeerTime: send}, -time.Millisecond)
+    if c.Offset() != 30*time.Millisecond {
+        t.Fatalf("offset = %v", c.Offset())
+    }
+}
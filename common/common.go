@@ -12,6 +12,13 @@ var (
     ErrorMessageFormatInvalid = errors.New("message format invalid")
     ErrorMessageTypeInvalid   = errors.New("message type invalid")
     ErrorConnectionInvalid    = errors.New("connection invalid")
+    ErrorConnectionClosed     = errors.New("connection closed")
+    ErrorClosedByPeer         = errors.New("connection closed by peer")
+    ErrorServiceNotFound      = errors.New("service not found")
+    ErrorRateLimited          = errors.New("rate limited")
+    ErrorMessageDropped       = errors.New("message dropped") // ServerBeforeHandlePlugin 返回时静默丢弃消息
+    ErrorTooManyConnections   = errors.New("too many connections")
+    ErrorTooManyConnectionsIP = errors.New("too many connections from ip")
 )
 
 type MessageType uint8
@@ -22,6 +29,16 @@ const (
     MessageTypeResponse = MessageType(3) // 请求消息的回复
     MessageTypeOneWay   = MessageType(4) // 单向消息，忽略回复
     MessageTypeClose    = MessageType(5) // 关闭消息
+    MessageTypeCloseAck = MessageType(6) // 关闭消息的确认, 发送前的回复都已写出
+    MessageTypeCall     = MessageType(7) // 按 servicePath/serviceMethod 分发的请求, 必须有回复
+    MessageTypeError    = MessageType(8) // 请求消息的错误回复, 内容为错误信息
+)
+
+const (
+    CloseCodeNormal = uint32(0)   // 正常关闭
+    CloseCodeError  = uint32(1)   // 链接出错, 没有完成关闭握手
+    CloseCodePolicy = uint32(2)   // 违反服务器的限制, 如限流
+    CloseCodeUser   = uint32(100) // 应用自定义的关闭码从这里开始
 )
 
 type (
@@ -30,6 +47,8 @@ type (
         Payload   []byte
         RequestId uint32
         SendCh    chan []byte
+        Done      <-chan struct{} // 链接关闭后停止发送
+        Err       error           // 请求因链接关闭而失败时设置, 不参与编码
     }
 )
 
@@ -40,20 +59,68 @@ func NewMessage(ch chan []byte) *Message {
 }
 
 func (m *Message) Reply(payload []byte) error {
-    if m.Type != MessageTypeRequest {
+    if m.Type != MessageTypeRequest && m.Type != MessageTypeCall {
         return ErrorMessageTypeInvalid
     }
     msg := NewMessage(m.SendCh)
     msg.Payload = payload
     msg.Type = MessageTypeResponse
     msg.RequestId = m.RequestId
-    msg.Emit()
-    return nil
+    msg.Done = m.Done
+    return msg.Emit()
 }
 
-func (m *Message) Emit() {
+// 以错误回复 Request, 对端的回调收到的消息 Err 为 ServiceError
+// Call 的错误在回复内容中, 见 EncodeCallError
+func (m *Message) ReplyError(err error) error {
+    if m.Type != MessageTypeRequest {
+        return ErrorMessageTypeInvalid
+    }
+    msg := NewMessage(m.SendCh)
+    msg.Payload = []byte(err.Error())
+    msg.Type = MessageTypeError
+    msg.RequestId = m.RequestId
+    msg.Done = m.Done
+    return msg.Emit()
+}
+
+func (m *Message) Emit() error {
     bin := m.Encode()
-    m.SendCh <- bin
+    select {
+    case m.SendCh <- bin:
+        return nil
+    case <-m.Done:
+        return ErrorConnectionClosed
+    }
+}
+
+// 编码后的消息长度
+func (m *Message) WireSize() int {
+    switch m.Type {
+    case MessageTypeRequest, MessageTypeResponse, MessageTypeCall, MessageTypeError:
+        return 1 + 4 + 4 + len(m.Payload)
+    }
+    return 1 + 4 + len(m.Payload)
+}
+
+// 关闭消息的内容: code(4) + reason
+func EncodeClosePayload(code uint32, reason string) []byte {
+    buffer := bytes.NewBuffer(nil)
+    writeUInt32(code, buffer)
+    buffer.WriteString(reason)
+    return buffer.Bytes()
+}
+
+func DecodeClosePayload(payload []byte) (uint32, string) {
+    if len(payload) < 4 {
+        return CloseCodeNormal, ""
+    }
+    return binary.BigEndian.Uint32(payload), string(payload[4:])
+}
+
+// 判断已编码的数据是否为关闭确认消息
+func IsCloseAckFrame(data []byte) bool {
+    return len(data) > 0 && MessageType(data[0]) == MessageTypeCloseAck
 }
 
 func readFull(r io.Reader, data []byte) (int, error) {
@@ -73,16 +140,13 @@ func (m *Message) Decode(conn *bufio.Reader) error {
         return err
     }
     m.Type = MessageType(header[0])
-    if m.Type == MessageTypeKeep {
-        return nil
-    }
     // size
     size, err = readUInt32(conn)
     if err != nil {
         return err
     }
     switch m.Type {
-    case MessageTypeRequest, MessageTypeResponse:
+    case MessageTypeRequest, MessageTypeResponse, MessageTypeCall, MessageTypeError:
         // request id
         m.RequestId, err = readUInt32(conn)
         if err != nil {
@@ -99,14 +163,11 @@ func (m *Message) Decode(conn *bufio.Reader) error {
 }
 
 func (m *Message) Encode() []byte {
-    if m.Type == MessageTypeKeep {
-        return []byte{uint8(m.Type)}
-    }
     buffer := bytes.NewBuffer(nil)
     buffer.Write([]byte{uint8(m.Type)})         // msg type  1
     writeUInt32(uint32(len(m.Payload)), buffer) // size  4
     switch m.Type {
-    case MessageTypeRequest, MessageTypeResponse:
+    case MessageTypeRequest, MessageTypeResponse, MessageTypeCall, MessageTypeError:
         writeUInt32(m.RequestId, buffer) // request id 4
     }
     buffer.Write(m.Payload)
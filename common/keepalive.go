@@ -0,0 +1,168 @@
+package common
+
+import (
+    "bytes"
+    "encoding/binary"
+    "sync"
+    "time"
+)
+
+type (
+    // 链接保持消息的内容
+    KeepAlive struct {
+        Pong     bool
+        SendTime int64 // 发送 ping 一方的时间(纳秒), pong 原样带回
+        PeerTime int64 // 回复 pong 一方的时间(纳秒)
+    }
+    // 根据 ping/pong 统计延迟, 并记录未回复的 ping 数量
+    KeepAliveStats struct {
+        mutex   sync.Mutex
+        rtt     time.Duration
+        jitter  time.Duration
+        samples int
+        missed  int
+        pending map[int64]time.Time // 未回复 ping 的 SendTime 和本地发送时间(单调时钟)
+    }
+)
+
+// 最多记录的未回复 ping, 超过时丢弃最早的
+const maxPendingPings = 64
+
+func (k *KeepAlive) Encode() []byte {
+    buffer := bytes.NewBuffer(nil)
+    if k.Pong {
+        buffer.WriteByte(1)
+    } else {
+        buffer.WriteByte(0)
+    }
+    writeUInt64(uint64(k.SendTime), buffer)
+    writeUInt64(uint64(k.PeerTime), buffer)
+    return buffer.Bytes()
+}
+
+// 没有内容的链接保持消息视为 ping
+func DecodeKeepAlive(payload []byte) (*KeepAlive, error) {
+    k := &KeepAlive{}
+    if len(payload) == 0 {
+        return k, nil
+    }
+    if len(payload) < 17 {
+        return nil, ErrorMessageFormatInvalid
+    }
+    k.Pong = payload[0] == 1
+    k.SendTime = int64(binary.BigEndian.Uint64(payload[1:]))
+    k.PeerTime = int64(binary.BigEndian.Uint64(payload[9:]))
+    return k, nil
+}
+
+// sendTime 由 KeepAliveStats.Track 得到
+func NewPingMessage(ch chan []byte, done <-chan struct{}, sendTime int64) *Message {
+    msg := NewMessage(ch)
+    msg.Done = done
+    msg.Type = MessageTypeKeep
+    msg.Payload = (&KeepAlive{SendTime: sendTime}).Encode()
+    return msg
+}
+
+// 回复 ping 的 pong 消息
+func NewPongMessage(ping *Message, k *KeepAlive) *Message {
+    msg := NewMessage(ping.SendCh)
+    msg.Done = ping.Done
+    msg.Type = MessageTypeKeep
+    msg.Payload = (&KeepAlive{
+        Pong:     true,
+        SendTime: k.SendTime,
+        PeerTime: time.Now().UnixNano(),
+    }).Encode()
+    return msg
+}
+
+func (s *KeepAliveStats) OnPing() {
+    s.mutex.Lock()
+    s.missed++
+    s.mutex.Unlock()
+}
+
+// 记录一个即将发出的 ping, 返回写入 ping 的 SendTime
+// RTT 按本地的单调时钟计算, 不受系统时间调整影响
+func (s *KeepAliveStats) Track() int64 {
+    now := time.Now()
+    sendTime := now.UnixNano()
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if s.pending == nil {
+        s.pending = make(map[int64]time.Time)
+    }
+    for {
+        if _, ok := s.pending[sendTime]; !ok {
+            break
+        }
+        sendTime++
+    }
+    if len(s.pending) >= maxPendingPings {
+        var (
+            oldest   int64
+            oldestAt time.Time
+        )
+        for k, v := range s.pending {
+            if oldestAt.IsZero() || v.Before(oldestAt) || v.Equal(oldestAt) && k < oldest {
+                oldest, oldestAt = k, v
+            }
+        }
+        delete(s.pending, oldest)
+    }
+    s.pending[sendTime] = now
+    return sendTime
+}
+
+// 收到 pong, 按 RFC 6298 的方式平滑 RTT 和抖动
+// 不是由 Track 记录的 ping 的回复只清零丢失计数, 返回 false
+func (s *KeepAliveStats) OnPong(k *KeepAlive) (time.Duration, bool) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.missed = 0
+    sentAt, ok := s.pending[k.SendTime]
+    if !ok {
+        return 0, false
+    }
+    delete(s.pending, k.SendTime)
+    sample := time.Since(sentAt)
+    if s.samples == 0 {
+        s.rtt = sample
+        s.jitter = sample / 2
+    } else {
+        diff := s.rtt - sample
+        if diff < 0 {
+            diff = -diff
+        }
+        s.jitter = (3*s.jitter + diff) / 4
+        s.rtt = (7*s.rtt + sample) / 8
+    }
+    s.samples++
+    return sample, true
+}
+
+func (s *KeepAliveStats) RTT() time.Duration {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.rtt
+}
+
+func (s *KeepAliveStats) Jitter() time.Duration {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.jitter
+}
+
+// 上次收到 pong 之后发出的 ping 数量
+func (s *KeepAliveStats) Missed() int {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.missed
+}
+
+func writeUInt64(val uint64, buffer *bytes.Buffer) {
+    data := make([]byte, 8)
+    binary.BigEndian.PutUint64(data, val)
+    buffer.Write(data)
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+    "testing"
+    "time"
+)
+
+// RTT 按 Track 记录的本地时间计算, 与 pong 带回的 SendTime 的值无关
+func TestKeepAliveStatsTrack(t *testing.T) {
+    var s KeepAliveStats
+    s.OnPing()
+    s.OnPing()
+    sendTime := s.Track()
+    time.Sleep(10 * time.Millisecond)
+    rtt, ok := s.OnPong(&KeepAlive{Pong: true, SendTime: sendTime})
+    if !ok || rtt < 10*time.Millisecond || rtt > time.Second {
+        t.Fatalf("rtt = %v, %v", rtt, ok)
+    }
+    if s.Missed() != 0 || s.RTT() != rtt {
+        t.Fatalf("missed = %d, RTT = %v", s.Missed(), s.RTT())
+    }
+    // 重复的和未记录的 pong 只清零丢失计数
+    s.OnPing()
+    if _, ok := s.OnPong(&KeepAlive{Pong: true, SendTime: sendTime}); ok {
+        t.Fatal("duplicate pong accepted")
+    }
+    if s.Missed() != 0 || s.RTT() != rtt {
+        t.Fatalf("missed = %d, RTT = %v", s.Missed(), s.RTT())
+    }
+}
+
+// 同一时刻记录的 ping 得到不同的 SendTime, 未回复的 ping 数量有上限
+func TestKeepAliveStatsPendingLimit(t *testing.T) {
+    var s KeepAliveStats
+    seen := make(map[int64]bool)
+    first := s.Track()
+    seen[first] = true
+    for i := 1; i < maxPendingPings+1; i++ {
+        sendTime := s.Track()
+        if seen[sendTime] {
+            t.Fatalf("duplicate SendTime %d", sendTime)
+        }
+        seen[sendTime] = true
+    }
+    if len(s.pending) != maxPendingPings {
+        t.Fatalf("pending = %d", len(s.pending))
+    }
+    if _, ok := s.OnPong(&KeepAlive{Pong: true, SendTime: first}); ok {
+        t.Fatal("oldest ping not dropped")
+    }
+}
@@ -1,15 +1,32 @@
 package common
 
+import "net"
+
 // server side
 type (
+    // 建立 Session 前调用, 返回错误时以 CloseCodePolicy 和错误信息关闭链接, 不会调用 OnAccept
+    ServerAcceptFilterPlugin interface {
+        FilterAccept(remoteAddr net.Addr) error
+    }
     ServerOnAcceptPlugin interface {
-        OnAccept(id uint64)
+        OnAccept(sess *Session)
     }
+    // 通过 sess.CloseCode() 区分正常关闭和异常断开(CloseCodeError)
     ServerOnClosePlugin interface {
-        OnClose(id uint64)
+        OnClose(sess *Session)
     }
     ServerOnMessagePlugin interface {
-        OnMessage(id uint64, msg *Message)
+        OnMessage(sess *Session, msg *Message)
+    }
+    // 处理 Request/OneWay/Call 前在链接的读取 goroutine 中调用, 返回错误时不再处理该消息:
+    // Call 和 Request 以该错误回复, 返回 ErrorMessageDropped 或消息为 OneWay 时静默丢弃
+    ServerBeforeHandlePlugin interface {
+        BeforeHandle(sess *Session, msg *Message) error
+    }
+    // 服务注册, Register 会被定时重复调用以续期
+    ServerRegisterPlugin interface {
+        Register(servicePath string, addr string, metadata string) error
+        Unregister(servicePath string, addr string) error
     }
 )
 
@@ -18,8 +35,9 @@ type (
     ClientOnOpenPlugin interface {
         OnOpen()
     }
+    // code 为 CloseCodeError 时表示链接异常断开, 否则为完成了关闭握手
     ClientOnClosePlugin interface {
-        OnClose()
+        OnClose(code uint32, reason string)
     }
     ClientOnMessagePlugin interface {
         OnMessage(msg *Message)
@@ -0,0 +1,67 @@
+package common
+
+import (
+    "math"
+    "time"
+)
+
+// 令牌桶, 不是并发安全的, 由调用方加锁
+type TokenBucket struct {
+    rate   float64
+    burst  float64
+    tokens float64
+    last   time.Time
+}
+
+// rate 为每秒补充的令牌数, burst 为容量, 不大于 0 时为 rate 向上取整
+func NewTokenBucket(rate float64, burst int, now time.Time) *TokenBucket {
+    if burst <= 0 {
+        burst = int(math.Ceil(rate))
+    }
+    return &TokenBucket{
+        rate:   rate,
+        burst:  float64(burst),
+        tokens: float64(burst),
+        last:   now,
+    }
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+    if now.After(b.last) {
+        b.tokens += now.Sub(b.last).Seconds() * b.rate
+        b.last = now
+    }
+    if b.tokens > b.burst {
+        b.tokens = b.burst
+    }
+}
+
+// 预留一个令牌, 令牌不足时余额为负, 返回需要等待的时间
+func (b *TokenBucket) Reserve(now time.Time) time.Duration {
+    b.refill(now)
+    b.tokens--
+    if b.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// 归还一个 Reserve 预留的令牌
+func (b *TokenBucket) Cancel() {
+    b.tokens++
+}
+
+// 有令牌时取走一个并返回 true
+func (b *TokenBucket) Allow(now time.Time) bool {
+    if b.Reserve(now) > 0 {
+        b.Cancel()
+        return false
+    }
+    return true
+}
+
+// 令牌已满, 与新建的令牌桶等价
+func (b *TokenBucket) Full(now time.Time) bool {
+    b.refill(now)
+    return b.tokens >= b.burst
+}
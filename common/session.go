@@ -0,0 +1,299 @@
+package common
+
+import (
+    "bufio"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type (
+    // 服务器端的一个客户端链接
+    Session struct {
+        stats       SessionStats
+        id          uint64
+        conn        net.Conn
+        sendCh      chan []byte
+        doneCh      chan struct{}
+        closeOnce   sync.Once
+        closeCode   uint32
+        closeReason string
+        closeMutex  sync.Mutex
+        localClose  *closeInfo // 本端发起的关闭, 等待确认
+        peerClose   *closeInfo // 对端发起的关闭, 确认写出后关闭
+        requests    *RequestManager
+        keepAlive   KeepAliveStats
+        createdAt   time.Time
+        attrMutex   sync.RWMutex
+        attrs       map[string]interface{}
+        callMutex   sync.Mutex
+        calls       int           // 进行中的 Call
+        callsIdle   chan struct{} // calls 变为 0 时关闭
+    }
+    SessionStats struct {
+        MessagesIn  uint64
+        MessagesOut uint64
+        BytesIn     uint64
+        BytesOut    uint64
+    }
+    closeInfo struct {
+        code   uint32
+        reason string
+    }
+)
+
+func NewSession(id uint64, conn net.Conn) *Session {
+    return &Session{
+        id:        id,
+        conn:      conn,
+        sendCh:    make(chan []byte),
+        doneCh:    make(chan struct{}),
+        requests:  NewRequestManager(),
+        createdAt: time.Now(),
+        attrs:     make(map[string]interface{}),
+    }
+}
+
+func (s *Session) ID() uint64 {
+    return s.id
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+    return s.conn.RemoteAddr()
+}
+
+func (s *Session) LocalAddr() net.Addr {
+    return s.conn.LocalAddr()
+}
+
+func (s *Session) CreatedAt() time.Time {
+    return s.createdAt
+}
+
+func (s *Session) Set(key string, value interface{}) {
+    s.attrMutex.Lock()
+    s.attrs[key] = value
+    s.attrMutex.Unlock()
+}
+
+func (s *Session) Get(key string) (interface{}, bool) {
+    s.attrMutex.RLock()
+    value, ok := s.attrs[key]
+    s.attrMutex.RUnlock()
+    return value, ok
+}
+
+func (s *Session) Delete(key string) {
+    s.attrMutex.Lock()
+    delete(s.attrs, key)
+    s.attrMutex.Unlock()
+}
+
+func (s *Session) Stats() SessionStats {
+    return SessionStats{
+        MessagesIn:  atomic.LoadUint64(&s.stats.MessagesIn),
+        MessagesOut: atomic.LoadUint64(&s.stats.MessagesOut),
+        BytesIn:     atomic.LoadUint64(&s.stats.BytesIn),
+        BytesOut:    atomic.LoadUint64(&s.stats.BytesOut),
+    }
+}
+
+// 立即关闭链接, 只有第一次调用的 reason 会被记录
+func (s *Session) Close(reason string) error {
+    return s.CloseWithCode(CloseCodeNormal, reason)
+}
+
+func (s *Session) CloseWithCode(code uint32, reason string) error {
+    return s.shutdown(code, reason, ErrorConnectionClosed)
+}
+
+// 发送关闭消息, 等待对端确认后关闭链接, 超时则直接关闭
+// 对端不读取数据时写出会阻塞, 超时同样包含发送关闭消息的时间
+func (s *Session) GracefulClose(code uint32, reason string, timeout time.Duration) error {
+    s.closeMutex.Lock()
+    if s.localClose == nil {
+        s.localClose = &closeInfo{code: code, reason: reason}
+    }
+    s.closeMutex.Unlock()
+    msg := s.NewMessage()
+    msg.Type = MessageTypeClose
+    msg.Payload = EncodeClosePayload(code, reason)
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    select {
+    case s.sendCh <- msg.Encode():
+    case <-s.doneCh:
+        return ErrorConnectionClosed
+    case <-timer.C:
+        return s.CloseWithCode(code, reason)
+    }
+    select {
+    case <-s.doneCh:
+    case <-timer.C:
+        _ = s.CloseWithCode(code, reason)
+    }
+    return nil
+}
+
+// 收到对端的关闭消息, 进行中的 Call 都回复后发送确认, 确认写出后关闭链接
+func (s *Session) HandleClose(msg *Message) error {
+    code, reason := DecodeClosePayload(msg.Payload)
+    s.closeMutex.Lock()
+    s.peerClose = &closeInfo{code: code, reason: reason}
+    s.closeMutex.Unlock()
+    ack := s.NewMessage()
+    ack.Type = MessageTypeCloseAck
+    idle := s.waitCalls()
+    select {
+    case <-idle:
+        return ack.Emit()
+    default:
+    }
+    go func() {
+        select {
+        case <-idle:
+            _ = ack.Emit()
+        case <-s.doneCh:
+        }
+    }()
+    return nil
+}
+
+// 开始处理一个 Call, 处理完成并回复后调用 EndCall
+func (s *Session) BeginCall() {
+    s.callMutex.Lock()
+    s.calls++
+    s.callMutex.Unlock()
+}
+
+func (s *Session) EndCall() {
+    s.callMutex.Lock()
+    s.calls--
+    if s.calls == 0 && s.callsIdle != nil {
+        close(s.callsIdle)
+        s.callsIdle = nil
+    }
+    s.callMutex.Unlock()
+}
+
+// 没有进行中的 Call 时关闭的 channel
+func (s *Session) waitCalls() <-chan struct{} {
+    s.callMutex.Lock()
+    defer s.callMutex.Unlock()
+    if s.calls == 0 {
+        ch := make(chan struct{})
+        close(ch)
+        return ch
+    }
+    if s.callsIdle == nil {
+        s.callsIdle = make(chan struct{})
+    }
+    return s.callsIdle
+}
+
+// 收到对端对关闭消息的确认
+func (s *Session) HandleCloseAck() {
+    s.closeMutex.Lock()
+    info := s.localClose
+    s.closeMutex.Unlock()
+    if info == nil {
+        info = &closeInfo{code: CloseCodeNormal}
+    }
+    _ = s.CloseWithCode(info.code, info.reason)
+}
+
+// 关闭链接, 未回复的请求以 err 结束
+func (s *Session) shutdown(code uint32, reason string, err error) error {
+    result := ErrorConnectionClosed
+    s.closeOnce.Do(func() {
+        s.closeCode = code
+        s.closeReason = reason
+        close(s.doneCh)
+        result = s.conn.Close()
+        s.requests.CloseAll(err)
+    })
+    return result
+}
+
+// 链接关闭的原因, 在 Done 关闭之后有效
+func (s *Session) CloseReason() string {
+    select {
+    case <-s.doneCh:
+        return s.closeReason
+    default:
+        return ""
+    }
+}
+
+func (s *Session) CloseCode() uint32 {
+    select {
+    case <-s.doneCh:
+        return s.closeCode
+    default:
+        return CloseCodeNormal
+    }
+}
+
+func (s *Session) Done() <-chan struct{} {
+    return s.doneCh
+}
+
+// 服务器发出 ping 测得的延迟, 需要开启 ServerOption.PingInterval
+func (s *Session) RTT() time.Duration {
+    return s.keepAlive.RTT()
+}
+
+func (s *Session) Jitter() time.Duration {
+    return s.keepAlive.Jitter()
+}
+
+func (s *Session) KeepAlive() *KeepAliveStats {
+    return &s.keepAlive
+}
+
+// 由本端发出的请求
+func (s *Session) Requests() *RequestManager {
+    return s.requests
+}
+
+func (s *Session) SendCh() chan []byte {
+    return s.sendCh
+}
+
+// 创建一条发往该链接的消息
+func (s *Session) NewMessage() *Message {
+    msg := NewMessage(s.sendCh)
+    msg.Done = s.doneCh
+    return msg
+}
+
+// 从链接读取一条消息
+func (s *Session) ReadMessage(r *bufio.Reader) (*Message, error) {
+    msg := s.NewMessage()
+    if err := msg.Decode(r); err != nil {
+        return nil, err
+    }
+    atomic.AddUint64(&s.stats.MessagesIn, 1)
+    atomic.AddUint64(&s.stats.BytesIn, uint64(msg.WireSize()))
+    return msg, nil
+}
+
+// 写出一条已编码的消息
+func (s *Session) WriteData(data []byte) error {
+    n, err := s.conn.Write(data)
+    atomic.AddUint64(&s.stats.BytesOut, uint64(n))
+    if err != nil {
+        return err
+    }
+    atomic.AddUint64(&s.stats.MessagesOut, 1)
+    if IsCloseAckFrame(data) {
+        s.closeMutex.Lock()
+        info := s.peerClose
+        s.closeMutex.Unlock()
+        if info != nil {
+            _ = s.shutdown(info.code, info.reason, ErrorClosedByPeer)
+        }
+    }
+    return nil
+}
@@ -40,7 +40,7 @@ func (h *clientHandler) OnMessage(message *common.Message) {
 
 }
 
-func (h *clientHandler) OnClose() {
+func (h *clientHandler) OnClose(code uint32, reason string) {
     isConnected = false
 }
 
@@ -17,11 +17,11 @@ var (
 type serverHandler struct {
 }
 
-func (h *serverHandler) OnAccept(id uint64) {
+func (h *serverHandler) OnAccept(sess *common.Session) {
 
 }
 
-func (h *serverHandler) OnMessage(id uint64, message *common.Message) {
+func (h *serverHandler) OnMessage(sess *common.Session, message *common.Message) {
     atomic.AddUint32(&qps, 1)
     err := message.Reply(message.Payload)
     if err != nil {
@@ -29,7 +29,7 @@ func (h *serverHandler) OnMessage(id uint64, message *common.Message) {
     }
 }
 
-func (h *serverHandler) OnClose(id uint64) {}
+func (h *serverHandler) OnClose(sess *common.Session) {}
 
 func main() {
     log.SetFlags(log.LstdFlags | log.Lshortfile)
@@ -0,0 +1,166 @@
+package rpc
+
+import (
+    "context"
+    "encoding/json"
+    "github.com/DGHeroin/rpc.go/common"
+    "sync"
+    "time"
+)
+
+type (
+    HealthStatus string
+    // Check 和 Watch 的参数, Service 为空时表示整个服务器
+    HealthRequest struct {
+        Service string       `json:"service"`
+        Status  HealthStatus `json:"status,omitempty"` // Watch 时为调用方已知的状态
+    }
+    HealthResponse struct {
+        Status HealthStatus `json:"status"`
+    }
+    // 内置的健康服务, 记录每个 servicePath 的状态
+    healthService struct {
+        mutex    sync.Mutex
+        status   map[string]HealthStatus
+        changeCh chan struct{} // 状态变化时关闭并重建
+    }
+)
+
+const (
+    HealthServing    HealthStatus = "SERVING"
+    HealthNotServing HealthStatus = "NOT_SERVING"
+    HealthUnknown    HealthStatus = "SERVICE_UNKNOWN"
+
+    // 健康服务的 servicePath 和方法, 不会注册到服务中心
+    HealthServicePath = "rpc.health"
+    HealthCheckMethod = "Check"
+    // 状态与调用方已知的不同时才回复, 否则等待变化, 最多等待 healthWatchTimeout 后回复当前状态
+    HealthWatchMethod = "Watch"
+
+    healthWatchTimeout = 30 * time.Second
+)
+
+func newHealthService() *healthService {
+    return &healthService{
+        status:   map[string]HealthStatus{"": HealthServing},
+        changeCh: make(chan struct{}),
+    }
+}
+
+func (h *healthService) get(service string) (HealthStatus, <-chan struct{}) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    status, ok := h.status[service]
+    if !ok {
+        status = HealthUnknown
+    }
+    return status, h.changeCh
+}
+
+func (h *healthService) set(service string, status HealthStatus) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    if h.status[service] == status {
+        return
+    }
+    h.status[service] = status
+    close(h.changeCh)
+    h.changeCh = make(chan struct{})
+}
+
+// 服务第一次添加时为 SERVING
+func (h *healthService) add(service string) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    if _, ok := h.status[service]; !ok {
+        h.status[service] = HealthServing
+        close(h.changeCh)
+        h.changeCh = make(chan struct{})
+    }
+}
+
+func (h *healthService) setAll(status HealthStatus) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    for service := range h.status {
+        h.status[service] = status
+    }
+    close(h.changeCh)
+    h.changeCh = make(chan struct{})
+}
+
+// Watch 在单独的 goroutine 中等待, 不阻塞链接的读取
+func (h *healthService) handle(sess *common.Session, msg *common.Message, serviceMethod string, payload []byte) error {
+    var req HealthRequest
+    if len(payload) > 0 {
+        if err := json.Unmarshal(payload, &req); err != nil {
+            return msg.Reply(common.EncodeCallError(err))
+        }
+    }
+    switch serviceMethod {
+    case HealthCheckMethod:
+        status, _ := h.get(req.Service)
+        return replyHealth(msg, status)
+    case HealthWatchMethod:
+        go h.watch(sess, msg, req)
+        return nil
+    default:
+        return msg.Reply(common.EncodeCallError(common.ErrorServiceNotFound))
+    }
+}
+
+func (h *healthService) watch(sess *common.Session, msg *common.Message, req HealthRequest) {
+    timer := time.NewTimer(healthWatchTimeout)
+    defer timer.Stop()
+    for {
+        status, changeCh := h.get(req.Service)
+        if status != req.Status {
+            _ = replyHealth(msg, status)
+            return
+        }
+        select {
+        case <-changeCh:
+        case <-timer.C:
+            _ = replyHealth(msg, status)
+            return
+        case <-sess.Done():
+            return
+        }
+    }
+}
+
+func replyHealth(msg *common.Message, status HealthStatus) error {
+    data, _ := json.Marshal(&HealthResponse{Status: status})
+    return msg.Reply(common.EncodeCallReply(data))
+}
+
+// 设置 servicePath 的健康状态, 空的 servicePath 表示整个服务器, 如维护时设置为 HealthNotServing
+func (s *Server) SetServingStatus(servicePath string, status HealthStatus) {
+    s.health.set(servicePath, status)
+}
+
+// 查询服务器上 servicePath 的健康状态
+func (c *Client) CheckHealth(ctx context.Context, servicePath string) (HealthStatus, error) {
+    return c.callHealth(ctx, HealthCheckMethod, &HealthRequest{Service: servicePath})
+}
+
+// 等待 servicePath 的状态与 known 不同时返回新的状态, 服务器等待超时时返回的状态可能与 known 相同
+func (c *Client) WatchHealth(ctx context.Context, servicePath string, known HealthStatus) (HealthStatus, error) {
+    return c.callHealth(ctx, HealthWatchMethod, &HealthRequest{Service: servicePath, Status: known})
+}
+
+func (c *Client) callHealth(ctx context.Context, serviceMethod string, req *HealthRequest) (HealthStatus, error) {
+    payload, err := json.Marshal(req)
+    if err != nil {
+        return "", err
+    }
+    data, err := c.Call(ctx, HealthServicePath, serviceMethod, payload)
+    if err != nil {
+        return "", err
+    }
+    var resp HealthResponse
+    if err = json.Unmarshal(data, &resp); err != nil {
+        return "", err
+    }
+    return resp.Status, nil
+}
@@ -0,0 +1,50 @@
+package rpc
+
+import (
+    "github.com/DGHeroin/rpc.go/common"
+    "time"
+)
+
+const defaultMaxMissedPings = 3
+
+// 按 interval 发送 ping, 连续 maxMissed 个 ping 没有回复时调用 onDead
+func keepAliveLoop(interval time.Duration, maxMissed int, stats *common.KeepAliveStats,
+    done <-chan struct{}, ping func() error, onDead func()) {
+    if maxMissed <= 0 {
+        maxMissed = defaultMaxMissedPings
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+            if stats.Missed() >= maxMissed {
+                onDead()
+                return
+            }
+            stats.OnPing()
+            if err := ping(); err != nil {
+                return
+            }
+        }
+    }
+}
+
+// 回复 ping, 或用 pong 更新延迟统计
+// 返回的 pong 是本端记录过的 ping 的回复, rtt 为这次的往返时间; 其他情况返回 nil
+func handleKeepAlive(msg *common.Message, stats *common.KeepAliveStats) (*common.KeepAlive, time.Duration, error) {
+    k, err := common.DecodeKeepAlive(msg.Payload)
+    if err != nil {
+        return nil, 0, err
+    }
+    if !k.Pong {
+        return nil, 0, common.NewPongMessage(msg, k).Emit()
+    }
+    rtt, ok := stats.OnPong(k)
+    if !ok {
+        return nil, 0, nil
+    }
+    return k, rtt, nil
+}
@@ -0,0 +1,122 @@
+package rpc
+
+import (
+    "context"
+    "github.com/DGHeroin/rpc.go/common"
+    "io"
+    "io/ioutil"
+    "net"
+    "testing"
+    "time"
+)
+
+// 只读取不回复的对端
+func silentPeer(t *testing.T) string {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { _ = ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                _, _ = io.Copy(ioutil.Discard, conn)
+                _ = conn.Close()
+            }()
+        }
+    }()
+    return ln.Addr().String()
+}
+
+// 连续 MaxMissedPings 个 ping 没有回复时客户端以 CloseCodeError 断开
+func TestClientKeepAliveDeadPeer(t *testing.T) {
+    conn, err := net.Dial("tcp", silentPeer(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    cli, _ := NewClient(&ClientOption{PingInterval: 20 * time.Millisecond, MaxMissedPings: 2})
+    cp := &clientClosePlugin{closed: make(chan closeInfo, 1)}
+    cli.AddPlugin(cp)
+    go func() { _ = cli.Serve(conn) }()
+    select {
+    case info := <-cp.closed:
+        if info.code != common.CloseCodeError || info.reason != "keepalive timeout" {
+            t.Fatalf("close = %d %q", info.code, info.reason)
+        }
+    case <-time.After(3 * time.Second):
+        t.Fatal("client not closed")
+    }
+}
+
+// 服务器对不回复 pong 的客户端同样断开
+func TestServerKeepAliveDeadPeer(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv, _ := NewServer(&ServerOption{PingInterval: 20 * time.Millisecond, MaxMissedPings: 2})
+    sp := &echoPlugin{accepted: make(chan *common.Session, 1), closed: make(chan *common.Session, 1)}
+    srv.AddPlugin(sp)
+    go func() { _ = srv.Serve(ln) }()
+    t.Cleanup(func() { _ = srv.Close() })
+
+    conn, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    go func() { _, _ = io.Copy(ioutil.Discard, conn) }()
+    <-sp.accepted
+    select {
+    case sess := <-sp.closed:
+        if sess.CloseCode() != common.CloseCodeError || sess.CloseReason() != "keepalive timeout" {
+            t.Fatalf("close = %d %q", sess.CloseCode(), sess.CloseReason())
+        }
+    case <-time.After(3 * time.Second):
+        t.Fatal("session not closed")
+    }
+}
+
+// 对端回复 pong 时链接保持, 并测得 RTT 和时钟差
+func TestKeepAliveAlivePeer(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv, _ := NewServer(nil)
+    go func() { _ = srv.Serve(ln) }()
+    t.Cleanup(func() { _ = srv.Close() })
+
+    conn, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    cli, _ := NewClient(&ClientOption{PingInterval: 10 * time.Millisecond, MaxMissedPings: 2})
+    cp := &clientClosePlugin{closed: make(chan closeInfo, 1)}
+    cli.AddPlugin(cp)
+    go func() { _ = cli.Serve(conn) }()
+    defer cli.Close()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    defer cancel()
+    rtt, err := cli.Ping(ctx)
+    if err != nil || rtt <= 0 {
+        t.Fatalf("Ping = %v, %v", rtt, err)
+    }
+    select {
+    case info := <-cp.closed:
+        t.Fatalf("closed %d %q", info.code, info.reason)
+    case <-time.After(100 * time.Millisecond):
+    }
+    if cli.RTT() <= 0 || cli.RTT() > time.Second {
+        t.Fatalf("RTT = %v", cli.RTT())
+    }
+    // 同一台机器上的时钟差不超过误差范围
+    if offset := cli.ClockOffset(); offset > cli.ClockError()+time.Millisecond || -offset > cli.ClockError()+time.Millisecond {
+        t.Fatalf("offset = %v, error = %v", offset, cli.ClockError())
+    }
+}
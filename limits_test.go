@@ -0,0 +1,112 @@
+package rpc
+
+import (
+    "errors"
+    "github.com/DGHeroin/rpc.go/common"
+    "net"
+    "testing"
+    "time"
+)
+
+type denyPlugin struct {
+    err error
+}
+
+func (p *denyPlugin) FilterAccept(remoteAddr net.Addr) error { return p.err }
+
+func newLimitServer(t *testing.T, opt *ServerOption, plugins ...interface{}) (*Server, *echoPlugin, string) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv, _ := NewServer(opt)
+    sp := &echoPlugin{accepted: make(chan *common.Session, 4), closed: make(chan *common.Session, 4)}
+    for _, p := range plugins {
+        srv.AddPlugin(p)
+    }
+    srv.AddPlugin(sp)
+    go func() { _ = srv.Serve(ln) }()
+    t.Cleanup(func() { _ = srv.Close() })
+    return srv, sp, ln.Addr().String()
+}
+
+func dialLimitClient(t *testing.T, addr string) (*Client, *clientClosePlugin) {
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cli, _ := NewClient(nil)
+    cp := &clientClosePlugin{closed: make(chan closeInfo, 1)}
+    cli.AddPlugin(cp)
+    go func() { _ = cli.Serve(conn) }()
+    t.Cleanup(cli.Close)
+    return cli, cp
+}
+
+// 被拒绝的客户端收到 CloseCodePolicy 和原因
+func expectRejected(t *testing.T, cp *clientClosePlugin, reason string) {
+    select {
+    case info := <-cp.closed:
+        if info.code != common.CloseCodePolicy || info.reason != reason {
+            t.Fatalf("close = %d %q, want %q", info.code, info.reason, reason)
+        }
+    case <-time.After(3 * time.Second):
+        t.Fatal("client not rejected")
+    }
+}
+
+func expectSession(t *testing.T, ch chan *common.Session) *common.Session {
+    select {
+    case sess := <-ch:
+        return sess
+    case <-time.After(3 * time.Second):
+        t.Fatal("timeout waiting for session")
+        return nil
+    }
+}
+
+func TestMaxConnections(t *testing.T) {
+    _, sp, addr := newLimitServer(t, &ServerOption{MaxConnections: 1})
+    first, _ := dialLimitClient(t, addr)
+    expectSession(t, sp.accepted)
+
+    _, cp := dialLimitClient(t, addr)
+    expectRejected(t, cp, common.ErrorTooManyConnections.Error())
+
+    // 链接关闭后名额释放
+    first.Close()
+    expectSession(t, sp.closed)
+    dialLimitClient(t, addr)
+    expectSession(t, sp.accepted)
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+    srv, sp, addr := newLimitServer(t, &ServerOption{MaxConnectionsPerIP: 1})
+    first, _ := dialLimitClient(t, addr)
+    expectSession(t, sp.accepted)
+
+    _, cp := dialLimitClient(t, addr)
+    expectRejected(t, cp, common.ErrorTooManyConnectionsIP.Error())
+
+    first.Close()
+    expectSession(t, sp.closed)
+    srv.mutex.RLock()
+    n, ok := srv.ipConns["127.0.0.1"]
+    srv.mutex.RUnlock()
+    if ok {
+        t.Fatalf("ipConns = %d after the session was removed", n)
+    }
+    dialLimitClient(t, addr)
+    expectSession(t, sp.accepted)
+}
+
+func TestAcceptFilterPlugin(t *testing.T) {
+    _, sp, addr := newLimitServer(t, nil, &denyPlugin{err: errors.New("banned")})
+    _, cp := dialLimitClient(t, addr)
+    expectRejected(t, cp, "banned")
+    select {
+    case <-sp.accepted:
+        t.Fatal("OnAccept called for a filtered connection")
+    default:
+    }
+}
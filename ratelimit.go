@@ -0,0 +1,135 @@
+package rpc
+
+import (
+    "github.com/DGHeroin/rpc.go/common"
+    "net"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type (
+    // 超过限制时的处理方式
+    OverflowMode int
+    RateLimitOption struct {
+        Rate     float64 // 每秒允许的消息数
+        Burst    int     // 令牌桶的容量, 默认为 Rate 向上取整
+        ByMethod bool    // Call 按 servicePath/serviceMethod 分别计数
+        ByIP     bool    // 按远端 IP 计数, 同一 IP 的链接共享令牌, 否则按链接计数
+        Overflow OverflowMode
+    }
+    // 被限制的消息数
+    RateLimitStats struct {
+        Allowed      uint64
+        Rejected     uint64
+        Dropped      uint64
+        Disconnected uint64
+    }
+    // 服务端限流插件, 通过 Server.AddPlugin 添加
+    RateLimitPlugin struct {
+        stats   RateLimitStats // 原子操作, 放在最前面保证对齐
+        option  RateLimitOption
+        mutex   sync.Mutex
+        buckets map[string]*common.TokenBucket
+        sweepAt time.Time
+    }
+)
+
+const (
+    OverflowReject     OverflowMode = iota // Call 和 Request 回复 ErrorRateLimited, OneWay 丢弃
+    OverflowDrop                           // 静默丢弃
+    OverflowDisconnect                     // 发送 CloseCodePolicy 的关闭消息后断开
+)
+
+const (
+    // 定时清理已满的令牌桶, 已满的与新建的等价
+    rateLimitSweepInterval = time.Minute
+    // 记录在 Session 上, 已开始断开的链接不再重复发送关闭消息
+    rateLimitClosingKey = "ratelimit.closing"
+)
+
+func NewRateLimitPlugin(option RateLimitOption) *RateLimitPlugin {
+    return &RateLimitPlugin{
+        option:  option,
+        buckets: make(map[string]*common.TokenBucket),
+        sweepAt: time.Now().Add(rateLimitSweepInterval),
+    }
+}
+
+// Rate 不大于 0 时不限制
+func (p *RateLimitPlugin) BeforeHandle(sess *common.Session, msg *common.Message) error {
+    if p.option.Rate <= 0 || p.allow(p.key(sess, msg)) {
+        atomic.AddUint64(&p.stats.Allowed, 1)
+        return nil
+    }
+    switch p.option.Overflow {
+    case OverflowReject:
+        if msg.Type != common.MessageTypeOneWay {
+            atomic.AddUint64(&p.stats.Rejected, 1)
+            return common.ErrorRateLimited
+        }
+        atomic.AddUint64(&p.stats.Dropped, 1)
+    case OverflowDisconnect:
+        // BeforeHandle 只在链接的读取 goroutine 中调用, 检查和设置之间没有竞争
+        if _, closing := sess.Get(rateLimitClosingKey); closing {
+            atomic.AddUint64(&p.stats.Dropped, 1)
+            break
+        }
+        sess.Set(rateLimitClosingKey, true)
+        atomic.AddUint64(&p.stats.Disconnected, 1)
+        go func() {
+            _ = sess.GracefulClose(common.CloseCodePolicy, common.ErrorRateLimited.Error(), kickFlushTimeout)
+        }()
+    default:
+        atomic.AddUint64(&p.stats.Dropped, 1)
+    }
+    return common.ErrorMessageDropped
+}
+
+func (p *RateLimitPlugin) Stats() RateLimitStats {
+    return RateLimitStats{
+        Allowed:      atomic.LoadUint64(&p.stats.Allowed),
+        Rejected:     atomic.LoadUint64(&p.stats.Rejected),
+        Dropped:      atomic.LoadUint64(&p.stats.Dropped),
+        Disconnected: atomic.LoadUint64(&p.stats.Disconnected),
+    }
+}
+
+func (p *RateLimitPlugin) key(sess *common.Session, msg *common.Message) string {
+    var key string
+    if p.option.ByIP {
+        key = sess.RemoteAddr().String()
+        if host, _, err := net.SplitHostPort(key); err == nil {
+            key = host
+        }
+    } else {
+        key = strconv.FormatUint(sess.ID(), 10)
+    }
+    if p.option.ByMethod && msg.Type == common.MessageTypeCall {
+        if servicePath, serviceMethod, _, err := common.DecodeCall(msg.Payload); err == nil {
+            key += "/" + servicePath + "/" + serviceMethod
+        }
+    }
+    return key
+}
+
+func (p *RateLimitPlugin) allow(key string) bool {
+    now := time.Now()
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    if now.After(p.sweepAt) {
+        for k, b := range p.buckets {
+            if b.Full(now) {
+                delete(p.buckets, k)
+            }
+        }
+        p.sweepAt = now.Add(rateLimitSweepInterval)
+    }
+    b, ok := p.buckets[key]
+    if !ok {
+        b = common.NewTokenBucket(p.option.Rate, p.option.Burst, now)
+        p.buckets[key] = b
+    }
+    return b.Allow(now)
+}
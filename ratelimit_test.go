@@ -0,0 +1,79 @@
+package rpc
+
+import (
+    "context"
+    "github.com/DGHeroin/rpc.go/common"
+    "testing"
+    "time"
+)
+
+// 超过限制的 Request 和 Call 都收到 ErrorRateLimited 的错误回复
+func TestRateLimitRejectRepliesWithError(t *testing.T) {
+    limiter := NewRateLimitPlugin(RateLimitOption{Rate: 0.001, Burst: 1, Overflow: OverflowReject})
+    srv, _, _, cli, _ := newClosePair(t, limiter)
+    srv.Handle("game", "Echo", func(sess *common.Session, payload []byte) ([]byte, error) {
+        return payload, nil
+    })
+
+    replies := make(chan *common.Message, 3)
+    for i := 0; i < 3; i++ {
+        if err := cli.Request([]byte("x"), func(msg *common.Message) { replies <- msg }); err != nil {
+            t.Fatal(err)
+        }
+    }
+    var ok, limited int
+    for i := 0; i < 3; i++ {
+        msg := waitMessage(t, replies)
+        switch {
+        case msg.Err == nil:
+            ok++
+        case msg.Err.Error() == common.ErrorRateLimited.Error():
+            limited++
+        default:
+            t.Fatalf("reply err = %v", msg.Err)
+        }
+    }
+    if ok != 1 || limited != 2 {
+        t.Fatalf("ok = %d, limited = %d", ok, limited)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    defer cancel()
+    if _, err := cli.Call(ctx, "game", "Echo", nil); err == nil || err.Error() != common.ErrorRateLimited.Error() {
+        t.Fatalf("Call err = %v", err)
+    }
+    if stats := limiter.Stats(); stats.Allowed != 1 || stats.Rejected != 3 {
+        t.Fatalf("stats = %+v", stats)
+    }
+}
+
+// 持续超过限制时只断开一次
+func TestRateLimitDisconnectOnce(t *testing.T) {
+    limiter := NewRateLimitPlugin(RateLimitOption{Rate: 0.001, Burst: 1, Overflow: OverflowDisconnect})
+    _, _, _, cli, cp := newClosePair(t, limiter)
+
+    // 先完成一次请求, 确认链接已经建立
+    replies := make(chan *common.Message, 1)
+    if err := cli.Request([]byte("x"), func(msg *common.Message) { replies <- msg }); err != nil {
+        t.Fatal(err)
+    }
+    if msg := waitMessage(t, replies); msg.Err != nil {
+        t.Fatal(msg.Err)
+    }
+    for i := 0; i < 50; i++ {
+        if err := cli.Push([]byte("x")); err != nil {
+            break
+        }
+    }
+    select {
+    case info := <-cp.closed:
+        if info.code != common.CloseCodePolicy {
+            t.Fatalf("close code = %d", info.code)
+        }
+    case <-time.After(3 * time.Second):
+        t.Fatal("client not disconnected")
+    }
+    if stats := limiter.Stats(); stats.Disconnected != 1 {
+        t.Fatalf("stats = %+v", stats)
+    }
+}
@@ -0,0 +1,281 @@
+package registry
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/DGHeroin/rpc.go"
+    "github.com/DGHeroin/rpc.go/client"
+    "github.com/DGHeroin/rpc.go/common"
+    "log"
+    "sync"
+    "time"
+)
+
+type (
+    // 到注册中心的链接, 断开后自动重连
+    remote struct {
+        addr      string
+        opt       DialOption
+        timeout   time.Duration
+        mutex     sync.Mutex
+        cli       *rpc.Client
+        readyCh   chan struct{} // 连上后关闭, 断开后重建
+        onConnect func()
+        onPush    func(resp *response)
+        exitCh    chan struct{}
+        once      sync.Once
+    }
+    remoteHandler struct {
+        r *remote
+    }
+    // 把 rpc.Server 注册到注册中心的插件
+    RegistryPlugin struct {
+        remote *remote
+    }
+    // 订阅注册中心的 client.Discovery
+    RegistryDiscovery struct {
+        servicePath string
+        remote      *remote
+        servers     *client.MultipleServersDiscovery
+        mutex       sync.Mutex
+        version     uint64 // 已使用的列表的版本, 重连后重置
+    }
+)
+
+const (
+    defaultRequestTimeout = 5 * time.Second
+    reconnectInterval     = time.Second
+)
+
+func newRemote(addr string, opt *DialOption) *remote {
+    if opt == nil {
+        opt = &DialOption{}
+    }
+    return &remote{
+        addr:    addr,
+        opt:     *opt,
+        timeout: defaultRequestTimeout,
+        readyCh: make(chan struct{}),
+        exitCh:  make(chan struct{}),
+    }
+}
+
+// 连接并在断开后重连, 直到 close
+func (r *remote) run() {
+    for {
+        conn, err := dial(r.addr, &r.opt)
+        if err == nil {
+            cli, _ := rpc.NewClient(nil)
+            cli.AddPlugin(&remoteHandler{r: r})
+            r.mutex.Lock()
+            select {
+            case <-r.exitCh:
+                r.mutex.Unlock()
+                _ = conn.Close()
+                return
+            default:
+            }
+            r.cli = cli
+            close(r.readyCh)
+            r.mutex.Unlock()
+            if r.onConnect != nil {
+                go r.onConnect()
+            }
+            err = cli.Serve(conn)
+            r.mutex.Lock()
+            r.cli = nil
+            r.readyCh = make(chan struct{})
+            r.mutex.Unlock()
+        }
+        if err != nil {
+            log.Println(r.addr, err)
+        }
+        select {
+        case <-r.exitCh:
+            return
+        case <-time.After(reconnectInterval):
+        }
+    }
+}
+
+func (r *remote) close() {
+    r.once.Do(func() {
+        close(r.exitCh)
+        r.mutex.Lock()
+        cli := r.cli
+        r.mutex.Unlock()
+        if cli != nil {
+            cli.Close()
+        }
+    })
+}
+
+// 未连接时等待连接, 最多等待 timeout
+func (r *remote) client() (*rpc.Client, error) {
+    r.mutex.Lock()
+    cli, ready := r.cli, r.readyCh
+    r.mutex.Unlock()
+    if cli != nil {
+        return cli, nil
+    }
+    select {
+    case <-ready:
+        return r.client()
+    case <-r.exitCh:
+        return nil, ErrorNotConnected
+    case <-time.After(r.timeout):
+        return nil, ErrorNotConnected
+    }
+}
+
+func (r *remote) call(req *request) (*response, error) {
+    cli, err := r.client()
+    if err != nil {
+        return nil, err
+    }
+    data, err := json.Marshal(req)
+    if err != nil {
+        return nil, err
+    }
+    ch := make(chan *common.Message, 1)
+    if err = cli.Request(data, func(msg *common.Message) {
+        ch <- msg
+    }); err != nil {
+        return nil, err
+    }
+    select {
+    case msg := <-ch:
+        if msg.Err != nil {
+            return nil, msg.Err
+        }
+        var resp response
+        if err = json.Unmarshal(msg.Payload, &resp); err != nil {
+            return nil, err
+        }
+        if resp.Error != "" {
+            return nil, errors.New(resp.Error)
+        }
+        return &resp, nil
+    case <-time.After(r.timeout):
+        return nil, ErrorTimeout
+    }
+}
+
+// 注册中心推送的服务列表
+func (h *remoteHandler) OnMessage(msg *common.Message) {
+    var resp response
+    if err := json.Unmarshal(msg.Payload, &resp); err != nil {
+        log.Println(err)
+        return
+    }
+    if resp.Op == OpUpdate && h.r.onPush != nil {
+        h.r.onPush(&resp)
+    }
+}
+
+// addr 为注册中心的地址, 可以带 kcp@ 前缀, opt 可以为 nil
+// 续期由 rpc.Server 定时调用 Register 完成, 间隔需小于注册中心的 TTL
+func NewRegistryPlugin(addr string, opt *DialOption) *RegistryPlugin {
+    p := &RegistryPlugin{remote: newRemote(addr, opt)}
+    go p.remote.run()
+    return p
+}
+
+func (p *RegistryPlugin) Register(servicePath string, addr string, metadata string) error {
+    _, err := p.remote.call(&request{
+        Op:          OpRegister,
+        ServicePath: servicePath,
+        Addr:        addr,
+        Metadata:    metadata,
+    })
+    return err
+}
+
+func (p *RegistryPlugin) Unregister(servicePath string, addr string) error {
+    _, err := p.remote.call(&request{
+        Op:          OpUnregister,
+        ServicePath: servicePath,
+        Addr:        addr,
+    })
+    return err
+}
+
+func (p *RegistryPlugin) Close() {
+    p.remote.close()
+}
+
+// 等待第一次订阅完成后返回, 之后断线重连时会重新订阅, opt 可以为 nil
+func NewRegistryDiscovery(addr string, servicePath string, timeout time.Duration, opt *DialOption) (*RegistryDiscovery, error) {
+    servers, _ := client.NewMultipleServersDiscovery(nil)
+    d := &RegistryDiscovery{
+        servicePath: servicePath,
+        remote:      newRemote(addr, opt),
+        servers:     servers,
+    }
+    ready := make(chan error, 1)
+    d.remote.onConnect = func() {
+        d.mutex.Lock()
+        d.version = 0
+        d.mutex.Unlock()
+        err := d.subscribe()
+        select {
+        case ready <- err:
+        default:
+        }
+    }
+    d.remote.onPush = func(resp *response) {
+        if resp.ServicePath == d.servicePath {
+            _ = d.update(resp)
+        }
+    }
+    go d.remote.run()
+    if timeout <= 0 {
+        timeout = defaultRequestTimeout
+    }
+    select {
+    case err := <-ready:
+        if err != nil {
+            d.Close()
+            return nil, err
+        }
+    case <-time.After(timeout):
+        d.Close()
+        return nil, ErrorTimeout
+    }
+    return d, nil
+}
+
+func (d *RegistryDiscovery) subscribe() error {
+    resp, err := d.remote.call(&request{
+        Op:          OpSubscribe,
+        ServicePath: d.servicePath,
+    })
+    if err != nil {
+        return err
+    }
+    return d.update(resp)
+}
+
+// 订阅的回复在推送之后处理时, 忽略其中更旧的列表
+func (d *RegistryDiscovery) update(resp *response) error {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    if resp.Version < d.version {
+        return nil
+    }
+    d.version = resp.Version
+    return d.servers.Update(resp.Servers)
+}
+
+func (d *RegistryDiscovery) GetServices() client.KVPairs {
+    return d.servers.GetServices()
+}
+
+func (d *RegistryDiscovery) WatchServices() <-chan client.KVPairs {
+    return d.servers.WatchServices()
+}
+
+func (d *RegistryDiscovery) Close() {
+    d.remote.close()
+    d.servers.Close()
+}
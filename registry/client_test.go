@@ -0,0 +1,35 @@
+package registry
+
+import (
+    "github.com/DGHeroin/rpc.go/kcp"
+    "testing"
+    "time"
+)
+
+// 通过加密的 kcp 注册和订阅
+func TestRegistryEncryptedKCP(t *testing.T) {
+    opt := &DialOption{Password: []byte("secret"), Salt: []byte("salt")}
+    ln, err := kcp.NewKCPListenerServe("127.0.0.1:0", opt.Password, opt.Salt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    server, _ := NewServer(time.Minute, nil)
+    go func() { _ = server.Serve(ln) }()
+    defer server.Close()
+    addr := "kcp@" + ln.Addr().String()
+
+    plugin := NewRegistryPlugin(addr, opt)
+    defer plugin.Close()
+    if err := plugin.Register("game", "tcp@127.0.0.1:9527", "weight=10"); err != nil {
+        t.Fatal(err)
+    }
+    d, err := NewRegistryDiscovery(addr, "game", 3*time.Second, opt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+    if pairs := d.GetServices(); len(pairs) != 1 || pairs[0].Key != "tcp@127.0.0.1:9527" {
+        t.Fatalf("GetServices = %v", pairs)
+    }
+}
+
@@ -0,0 +1,147 @@
+package registry
+
+import (
+    "github.com/DGHeroin/rpc.go/client"
+    "sort"
+    "sync"
+    "time"
+)
+
+type (
+    // 进程内的服务中心, 超过 TTL 没有续期的注册项会被移除
+    // 可作为 rpc.Server 的插件, 通过 Discovery 给 client.NewClient 使用
+    MemoryRegistry struct {
+        ttl         time.Duration
+        mutex       sync.Mutex
+        services    map[string]map[string]*entry // servicePath -> addr -> entry
+        discoveries map[string][]*client.MultipleServersDiscovery
+        exitCh      chan struct{}
+        once        sync.Once
+    }
+    entry struct {
+        metadata string
+        expireAt time.Time
+    }
+)
+
+const DefaultTTL = 30 * time.Second
+
+func NewMemoryRegistry(ttl time.Duration) *MemoryRegistry {
+    if ttl <= 0 {
+        ttl = DefaultTTL
+    }
+    r := &MemoryRegistry{
+        ttl:         ttl,
+        services:    make(map[string]map[string]*entry),
+        discoveries: make(map[string][]*client.MultipleServersDiscovery),
+        exitCh:      make(chan struct{}),
+    }
+    go r.reap()
+    return r
+}
+
+// 注册或续期
+func (r *MemoryRegistry) Register(servicePath string, addr string, metadata string) error {
+    if _, err := client.ParseKVPair(addr + "?" + metadata); err != nil {
+        return err
+    }
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    servers, ok := r.services[servicePath]
+    if !ok {
+        servers = make(map[string]*entry)
+        r.services[servicePath] = servers
+    }
+    e, ok := servers[addr]
+    changed := !ok || e.metadata != metadata
+    servers[addr] = &entry{metadata: metadata, expireAt: time.Now().Add(r.ttl)}
+    if changed {
+        r.notifyLocked(servicePath)
+    }
+    return nil
+}
+
+func (r *MemoryRegistry) Unregister(servicePath string, addr string) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if _, ok := r.services[servicePath][addr]; ok {
+        delete(r.services[servicePath], addr)
+        r.notifyLocked(servicePath)
+    }
+    return nil
+}
+
+// 当前注册的服务器
+func (r *MemoryRegistry) GetServices(servicePath string) client.KVPairs {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.pairsLocked(servicePath)
+}
+
+// 返回一个跟随注册变化的 client.Discovery
+func (r *MemoryRegistry) Discovery(servicePath string) client.Discovery {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    d, _ := client.NewMultipleServersDiscovery(r.pairsLocked(servicePath))
+    r.discoveries[servicePath] = append(r.discoveries[servicePath], d)
+    return d
+}
+
+func (r *MemoryRegistry) Close() {
+    r.once.Do(func() {
+        close(r.exitCh)
+        r.mutex.Lock()
+        defer r.mutex.Unlock()
+        for _, ds := range r.discoveries {
+            for _, d := range ds {
+                d.Close()
+            }
+        }
+    })
+}
+
+func (r *MemoryRegistry) pairsLocked(servicePath string) client.KVPairs {
+    servers := r.services[servicePath]
+    pairs := make(client.KVPairs, 0, len(servers))
+    for addr, e := range servers {
+        pairs = append(pairs, client.KVPair{Key: addr, Value: e.metadata})
+    }
+    sort.Slice(pairs, func(i, j int) bool {
+        return pairs[i].Key < pairs[j].Key
+    })
+    return pairs
+}
+
+func (r *MemoryRegistry) notifyLocked(servicePath string) {
+    pairs := r.pairsLocked(servicePath)
+    for _, d := range r.discoveries[servicePath] {
+        _ = d.Update(pairs)
+    }
+}
+
+// 移除过期的注册项
+func (r *MemoryRegistry) reap() {
+    ticker := time.NewTicker(r.ttl / 2)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-r.exitCh:
+            return
+        case now := <-ticker.C:
+            r.mutex.Lock()
+            for servicePath, servers := range r.services {
+                expired := false
+                for addr, e := range servers {
+                    if now.After(e.expireAt) {
+                        delete(servers, addr)
+                        expired = true
+                    }
+                }
+                if expired {
+                    r.notifyLocked(servicePath)
+                }
+            }
+            r.mutex.Unlock()
+        }
+    }
+}
@@ -0,0 +1,63 @@
+package registry
+
+import (
+    "errors"
+    "github.com/DGHeroin/rpc.go/client"
+    "github.com/DGHeroin/rpc.go/kcp"
+    "net"
+    "strings"
+    "time"
+)
+
+// 注册中心的请求类型, 请求和回复的内容为 JSON
+const (
+    OpRegister    = "register"    // 注册或续期
+    OpUnregister  = "unregister"  // 注销
+    OpSubscribe   = "subscribe"   // 订阅服务, 回复当前列表, 之后变化时推送 OpUpdate
+    OpUnsubscribe = "unsubscribe" // 取消订阅
+    OpUpdate      = "update"      // 服务器推送的服务列表
+)
+
+var (
+    ErrorOpInvalid    = errors.New("registry op invalid")
+    ErrorNotConnected = errors.New("registry not connected")
+    ErrorTimeout      = errors.New("registry request timeout")
+)
+
+type (
+    // 到注册中心的链接参数, 与 rpc-registry 的 -password 和 -salt 对应
+    DialOption struct {
+        Password    []byte        // kcp 加密, 与 Salt 同时设置时生效
+        Salt        []byte
+        DialTimeout time.Duration // tcp 建立链接的超时, 默认 5 秒; kcp 无需握手, 不受限制
+    }
+    request struct {
+        Op          string `json:"op"`
+        ServicePath string `json:"service_path"`
+        Addr        string `json:"addr,omitempty"`
+        Metadata    string `json:"metadata,omitempty"`
+    }
+    response struct {
+        Op          string         `json:"op,omitempty"`
+        ServicePath string         `json:"service_path,omitempty"`
+        Servers     client.KVPairs `json:"servers,omitempty"`
+        Version     uint64         `json:"version,omitempty"` // 列表的版本, 每次变化加一, 客户端忽略更旧的列表
+        Error       string         `json:"error,omitempty"`
+    }
+)
+
+// 地址可以带 kcp@ 前缀, 默认 tcp
+func dial(addr string, opt *DialOption) (net.Conn, error) {
+    network, address := "tcp", addr
+    if ss := strings.SplitN(addr, "@", 2); len(ss) == 2 {
+        network, address = ss[0], ss[1]
+    }
+    if network == "kcp" {
+        return kcp.NewKCPDialer(address, opt.Password, opt.Salt)
+    }
+    timeout := opt.DialTimeout
+    if timeout <= 0 {
+        timeout = defaultRequestTimeout
+    }
+    return net.DialTimeout(network, address, timeout)
+}
@@ -0,0 +1,200 @@
+package registry
+
+import (
+    "encoding/json"
+    "github.com/DGHeroin/rpc.go"
+    "github.com/DGHeroin/rpc.go/client"
+    "github.com/DGHeroin/rpc.go/common"
+    "log"
+    "net"
+    "sync"
+    "time"
+)
+
+type (
+    // 基于 rpc.Server 的注册中心: 服务器定时注册续期, 客户端订阅服务并接收变化推送
+    Server struct {
+        server      *rpc.Server
+        memory      *MemoryRegistry
+        mutex       sync.Mutex
+        subscribers map[string]map[uint64]*common.Session // servicePath -> session
+        lists       map[string]*serviceList                // servicePath -> 最近推送的列表
+    }
+    serviceList struct {
+        version uint64
+        servers client.KVPairs
+    }
+    serverHandler struct {
+        s *Server
+    }
+    // 记录在 Session 上的注册项, 链接断开时注销
+    registration struct {
+        servicePath string
+        addr        string
+    }
+)
+
+const (
+    sessionRegistrationsKey = "registry.registrations"
+    // 推送给一个订阅者的超时, 超时的订阅者被断开, 重连后重新订阅
+    pushTimeout = time.Second
+)
+
+// ttl 为注册项的有效期, 服务器需要在此之前续期
+func NewServer(ttl time.Duration, opt *rpc.ServerOption) (*Server, error) {
+    server, err := rpc.NewServer(opt)
+    if err != nil {
+        return nil, err
+    }
+    s := &Server{
+        server:      server,
+        memory:      NewMemoryRegistry(ttl),
+        subscribers: make(map[string]map[uint64]*common.Session),
+        lists:       make(map[string]*serviceList),
+    }
+    server.AddPlugin(&serverHandler{s: s})
+    return s, nil
+}
+
+func (s *Server) Serve(ln net.Listener) error {
+    return s.server.Serve(ln)
+}
+
+func (s *Server) Close() error {
+    s.memory.Close()
+    return s.server.Close()
+}
+
+// 当前注册的服务器
+func (s *Server) GetServices(servicePath string) client.KVPairs {
+    return s.memory.GetServices(servicePath)
+}
+
+func (h *serverHandler) OnMessage(sess *common.Session, msg *common.Message) {
+    var (
+        req  request
+        resp response
+    )
+    if err := json.Unmarshal(msg.Payload, &req); err != nil {
+        resp.Error = err.Error()
+    } else if err = h.s.handle(sess, &req, &resp); err != nil {
+        resp.Error = err.Error()
+    }
+    if msg.Type != common.MessageTypeRequest {
+        return
+    }
+    data, _ := json.Marshal(&resp)
+    if err := msg.Reply(data); err != nil {
+        log.Println(err)
+    }
+}
+
+func (h *serverHandler) OnClose(sess *common.Session) {
+    h.s.mutex.Lock()
+    for _, sessions := range h.s.subscribers {
+        delete(sessions, sess.ID())
+    }
+    h.s.mutex.Unlock()
+    if v, ok := sess.Get(sessionRegistrationsKey); ok {
+        for r := range v.(map[registration]bool) {
+            _ = h.s.memory.Unregister(r.servicePath, r.addr)
+        }
+    }
+}
+
+func (s *Server) handle(sess *common.Session, req *request, resp *response) error {
+    switch req.Op {
+    case OpRegister:
+        if err := s.memory.Register(req.ServicePath, req.Addr, req.Metadata); err != nil {
+            return err
+        }
+        s.sessionRegistrations(sess)[registration{servicePath: req.ServicePath, addr: req.Addr}] = true
+    case OpUnregister:
+        delete(s.sessionRegistrations(sess), registration{servicePath: req.ServicePath, addr: req.Addr})
+        return s.memory.Unregister(req.ServicePath, req.Addr)
+    case OpSubscribe:
+        resp.Servers, resp.Version = s.subscribe(sess, req.ServicePath)
+    case OpUnsubscribe:
+        s.mutex.Lock()
+        delete(s.subscribers[req.ServicePath], sess.ID())
+        s.mutex.Unlock()
+    default:
+        return ErrorOpInvalid
+    }
+    resp.Op = req.Op
+    resp.ServicePath = req.ServicePath
+    return nil
+}
+
+// 只在 session 的读协程中访问
+func (s *Server) sessionRegistrations(sess *common.Session) map[registration]bool {
+    if v, ok := sess.Get(sessionRegistrationsKey); ok {
+        return v.(map[registration]bool)
+    }
+    m := make(map[registration]bool)
+    sess.Set(sessionRegistrationsKey, m)
+    return m
+}
+
+// 第一次订阅某个服务时开始监听它的变化, 返回当前的列表和版本
+// 回复和推送可能乱序到达, 客户端按版本忽略更旧的列表
+func (s *Server) subscribe(sess *common.Session, servicePath string) (client.KVPairs, uint64) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    sessions, ok := s.subscribers[servicePath]
+    if !ok {
+        sessions = make(map[uint64]*common.Session)
+        s.subscribers[servicePath] = sessions
+        d := s.memory.Discovery(servicePath)
+        ch := d.WatchServices()
+        s.lists[servicePath] = &serviceList{servers: d.GetServices()}
+        go s.watch(servicePath, ch)
+    }
+    sessions[sess.ID()] = sess
+    l := s.lists[servicePath]
+    return l.servers, l.version
+}
+
+func (s *Server) watch(servicePath string, ch <-chan client.KVPairs) {
+    for pairs := range ch {
+        s.mutex.Lock()
+        l := s.lists[servicePath]
+        l.version++
+        l.servers = pairs
+        data, _ := json.Marshal(&response{
+            Op:          OpUpdate,
+            ServicePath: servicePath,
+            Servers:     pairs,
+            Version:     l.version,
+        })
+        sessions := make([]*common.Session, 0, len(s.subscribers[servicePath]))
+        for _, sess := range s.subscribers[servicePath] {
+            sessions = append(sessions, sess)
+        }
+        s.mutex.Unlock()
+        s.push(sessions, data)
+    }
+}
+
+// 同时推送给所有订阅者, 一个订阅者不读取数据不影响其他订阅者
+func (s *Server) push(sessions []*common.Session, data []byte) {
+    var wg sync.WaitGroup
+    for _, sess := range sessions {
+        wg.Add(1)
+        go func(sess *common.Session) {
+            defer wg.Done()
+            msg := sess.NewMessage()
+            msg.Type = common.MessageTypeOneWay
+            msg.Payload = data
+            timer := time.NewTimer(pushTimeout)
+            defer timer.Stop()
+            select {
+            case sess.SendCh() <- msg.Encode():
+            case <-sess.Done():
+            case <-timer.C:
+                _ = sess.CloseWithCode(common.CloseCodeError, "registry push timeout")
+            }
+        }(sess)
+    }
+    wg.Wait()
+}
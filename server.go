@@ -14,29 +14,54 @@ type (
         address         string
         mutex           sync.RWMutex
         clientId        uint64
-        sessions        map[uint64]chan []byte
-        requestManager  *common.RequestManager
+        sessions        map[uint64]*common.Session
         option          ServerOption
         pluginContainer common.PluginContainer
         exitChan        chan bool
+        exitOnce        sync.Once
+        listener        net.Listener
+        services        map[string]string  // servicePath -> metadata
+        handlers        map[string]Handler // servicePath/serviceMethod -> handler
+        health          *healthService
+        ipConns         map[string]int // 每个 IP 的链接数
     }
+    // 处理 MessageTypeCall 请求, 返回值作为回复, error 作为 ServiceError 返回给调用方
+    // 每个调用在单独的 goroutine 中执行, 同一链接上的调用可能并发
+    Handler func(sess *common.Session, payload []byte) ([]byte, error)
     ServerOption struct {
-        ReadTimeout  time.Duration
-        WriteTimeout time.Duration
+        ReadTimeout    time.Duration
+        WriteTimeout   time.Duration
+        PingInterval   time.Duration // 服务器主动 ping 的间隔, 0 为不发送, 此时 Session.RTT() 为 0
+        MaxMissedPings int           // 连续多少个 ping 没有回复时断开, 默认 3
+        // 注册到服务中心的地址, 如 kcp@1.2.3.4:9527, 默认为监听地址
+        Advertise string
+        // 重新注册以续期的间隔, 默认 10 秒
+        RegisterInterval time.Duration
+        // 超过时以 CloseCodePolicy 拒绝新链接, 0 为不限制
+        MaxConnections      int
+        MaxConnectionsPerIP int
     }
 )
 
+const (
+    kickFlushTimeout        = time.Second
+    defaultRegisterInterval = 10 * time.Second
+)
+
 // 创建服务器
 func NewServer(opt *ServerOption) (*Server, error) {
     if opt == nil {
         opt = defaultServerOption()
     }
     s := &Server{
-        option:         *opt,
-        requestManager: common.NewRequestManager(),
-        exitChan:       make(chan bool),
+        option:   *opt,
+        exitChan: make(chan bool),
+        services: make(map[string]string),
+        handlers: make(map[string]Handler),
+        health:   newHealthService(),
+        ipConns:  make(map[string]int),
     }
-    s.sessions = make(map[uint64]chan []byte)
+    s.sessions = make(map[uint64]*common.Session)
     return s, nil
 }
 
@@ -50,111 +75,345 @@ func (s *Server) AddPlugin(p interface{}) {
 func (s *Server) RemovePlugin(p interface{}) {
     s.pluginContainer.Remove(p)
 }
+// 添加一个服务, Serve 时通过 ServerRegisterPlugin 注册, metadata 格式同 URL query
+func (s *Server) AddService(servicePath string, metadata string) {
+    s.mutex.Lock()
+    s.services[servicePath] = metadata
+    s.mutex.Unlock()
+    s.health.add(servicePath)
+}
+
+// 注册 servicePath/serviceMethod 的处理函数, servicePath 没有添加过时以空的 metadata 添加
+func (s *Server) Handle(servicePath string, serviceMethod string, handler Handler) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if _, ok := s.services[servicePath]; !ok {
+        s.services[servicePath] = ""
+    }
+    s.handlers[servicePath+"/"+serviceMethod] = handler
+    s.health.add(servicePath)
+}
+
 func (s *Server) Serve(ln net.Listener) error {
+    s.mutex.Lock()
+    select {
+    case <-s.exitChan:
+        s.mutex.Unlock()
+        _ = ln.Close()
+        return nil
+    default:
+    }
+    s.listener = ln
+    s.address = s.option.Advertise
+    if s.address == "" {
+        s.address = ln.Addr().String()
+    }
+    s.mutex.Unlock()
+    stopCh := make(chan struct{})
+    loopDone := make(chan struct{})
+    go func() {
+        defer close(loopDone)
+        s.registerLoop(stopCh)
+    }()
     for {
         conn, err := ln.Accept()
         if err != nil {
+            // 等待进行中的注册结束后再注销
+            close(stopCh)
+            <-loopDone
+            select {
+            case <-s.exitChan:
+                return nil
+            default:
+            }
+            s.unregisterServices()
             return err
         }
         go s.handleConn(conn)
 
     }
 }
-func (s *Server) addClient() (uint64, chan []byte) {
+
+// 注销服务, 停止监听, 关闭所有链接, 健康状态先变为 HealthNotServing
+func (s *Server) Close() error {
+    var err error
+    s.exitOnce.Do(func() {
+        s.health.setAll(HealthNotServing)
+        close(s.exitChan)
+        s.unregisterServices()
+        s.mutex.RLock()
+        ln := s.listener
+        s.mutex.RUnlock()
+        if ln != nil {
+            err = ln.Close()
+        }
+        var wg sync.WaitGroup
+        s.RangeSessions(func(sess *common.Session) {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                _ = sess.GracefulClose(common.CloseCodeNormal, "server shutdown", kickFlushTimeout)
+            }()
+        })
+        wg.Wait()
+    })
+    return err
+}
+
+func (s *Server) registerServices() error {
+    s.mutex.RLock()
+    addr := s.address
+    services := make(map[string]string, len(s.services))
+    for k, v := range s.services {
+        services[k] = v
+    }
+    s.mutex.RUnlock()
+    var err error
+    s.pluginContainer.Range(func(i interface{}) {
+        if p, ok := i.(common.ServerRegisterPlugin); ok {
+            for servicePath, metadata := range services {
+                if e := p.Register(servicePath, addr, metadata); e != nil && err == nil {
+                    err = e
+                }
+            }
+        }
+    })
+    return err
+}
+
+func (s *Server) unregisterServices() {
+    s.mutex.RLock()
+    addr := s.address
+    services := make([]string, 0, len(s.services))
+    for k := range s.services {
+        services = append(services, k)
+    }
+    s.mutex.RUnlock()
+    s.pluginContainer.Range(func(i interface{}) {
+        if p, ok := i.(common.ServerRegisterPlugin); ok {
+            for _, servicePath := range services {
+                if err := p.Unregister(servicePath, addr); err != nil {
+                    log.Println(err)
+                }
+            }
+        }
+    })
+}
+
+// 立即注册, 之后定时重新注册, 为服务中心的 TTL 续期
+// 注册失败时只记录日志, 服务中心暂时不可用不影响提供服务, 下次重试
+func (s *Server) registerLoop(stopCh chan struct{}) {
+    interval := s.option.RegisterInterval
+    if interval <= 0 {
+        interval = defaultRegisterInterval
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        if err := s.registerServices(); err != nil {
+            log.Println(err)
+        }
+        // Close 可能在注册过程中已经注销过
+        select {
+        case <-s.exitChan:
+            s.unregisterServices()
+            return
+        default:
+        }
+        select {
+        case <-stopCh:
+            return
+        case <-s.exitChan:
+            return
+        case <-ticker.C:
+        }
+    }
+}
+// 超过链接数限制时返回错误, 不创建 Session
+func (s *Server) addClient(conn net.Conn) (*common.Session, error) {
+    ip := remoteIP(conn.RemoteAddr())
     s.mutex.Lock()
     defer s.mutex.Unlock()
-    var id uint64
+    if s.option.MaxConnections > 0 && len(s.sessions) >= s.option.MaxConnections {
+        return nil, common.ErrorTooManyConnections
+    }
+    if s.option.MaxConnectionsPerIP > 0 && s.ipConns[ip] >= s.option.MaxConnectionsPerIP {
+        return nil, common.ErrorTooManyConnectionsIP
+    }
     for {
-        id = s.clientId
+        id := s.clientId
         if _, ok := s.sessions[id]; !ok {
-            ch := make(chan []byte)
-            s.sessions[id] = ch
+            sess := common.NewSession(id, conn)
+            s.sessions[id] = sess
+            s.ipConns[ip]++
             s.pluginContainer.Range(func(i interface{}) {
                 if p, ok2 := i.(common.ServerOnAcceptPlugin); ok2 {
-                    p.OnAccept(id)
+                    p.OnAccept(sess)
                 }
             })
-            return id, ch
+            return sess, nil
         }
         s.clientId++
     }
 }
-func (s *Server) removeClient(id uint64) {
+func (s *Server) removeClient(sess *common.Session) {
     s.mutex.Lock()
     defer s.mutex.Unlock()
-    if _, ok := s.sessions[id]; ok {
-        delete(s.sessions, id)
+    if _, ok := s.sessions[sess.ID()]; ok {
+        delete(s.sessions, sess.ID())
+        ip := remoteIP(sess.RemoteAddr())
+        if s.ipConns[ip]--; s.ipConns[ip] <= 0 {
+            delete(s.ipConns, ip)
+        }
         s.pluginContainer.Range(func(i interface{}) {
             if p, ok2 := i.(common.ServerOnClosePlugin); ok2 {
-                p.OnClose(id)
+                p.OnClose(sess)
             }
         })
     }
 }
+
+// 依次调用 ServerAcceptFilterPlugin, 返回第一个错误
+func (s *Server) filterAccept(conn net.Conn) error {
+    var err error
+    s.pluginContainer.Range(func(i interface{}) {
+        if p, ok := i.(common.ServerAcceptFilterPlugin); ok && err == nil {
+            err = p.FilterAccept(conn.RemoteAddr())
+        }
+    })
+    return err
+}
+
+// 发送带原因的关闭消息, 等待对端确认后断开, 对端由此得知被拒绝的原因
+func (s *Server) rejectConn(conn net.Conn, reason error) {
+    defer conn.Close()
+    _ = conn.SetDeadline(time.Now().Add(kickFlushTimeout))
+    msg := common.NewMessage(nil)
+    msg.Type = common.MessageTypeClose
+    msg.Payload = common.EncodeClosePayload(common.CloseCodePolicy, reason.Error())
+    if _, err := conn.Write(msg.Encode()); err != nil {
+        return
+    }
+    r := bufio.NewReader(conn)
+    for {
+        ack := common.NewMessage(nil)
+        if err := ack.Decode(r); err != nil || ack.Type == common.MessageTypeCloseAck {
+            return
+        }
+    }
+}
+
+func remoteIP(addr net.Addr) string {
+    if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+        return host
+    }
+    return addr.String()
+}
+
+// 按 id 查找链接, 不存在时返回 nil
+func (s *Server) Session(id uint64) *common.Session {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+    return s.sessions[id]
+}
+
+// 遍历当前所有链接
+func (s *Server) RangeSessions(fn func(sess *common.Session)) {
+    s.mutex.RLock()
+    sessions := make([]*common.Session, 0, len(s.sessions))
+    for _, sess := range s.sessions {
+        sessions = append(sessions, sess)
+    }
+    s.mutex.RUnlock()
+    for _, sess := range sessions {
+        fn(sess)
+    }
+}
 func (s *Server) handleConn(conn net.Conn) {
     var (
-        err error
-        msg *common.Message
-        wg  sync.WaitGroup
-        r *bufio.Reader
+        wg sync.WaitGroup
+        r  *bufio.Reader
     )
+    if err := s.filterAccept(conn); err != nil {
+        s.rejectConn(conn, err)
+        return
+    }
+    sess, err := s.addClient(conn)
+    if err != nil {
+        s.rejectConn(conn, err)
+        return
+    }
     r = bufio.NewReaderSize(conn, 16*1024)
-    exitCh := make(chan bool)
-    id, sendCh := s.addClient()
     defer func() {
-        s.removeClient(id)
+        s.removeClient(sess)
     }()
     wg.Add(1)
     go func() {
+        var err error
         defer func() {
             wg.Done()
-            _ = conn.Close()
+            if err != nil {
+                _ = sess.CloseWithCode(common.CloseCodeError, err.Error())
+            }
         }()
         for {
             select {
-            case <-exitCh:
+            case <-sess.Done():
                 return
-            case data := <-sendCh:
-                if data == nil {
-                    return
-                }
+            case data := <-sess.SendCh():
                 if err = s.setWriteTimeout(conn); err != nil {
                     return
                 }
-                _, err = conn.Write(data)
-                if err != nil {
+                if err = sess.WriteData(data); err != nil {
                     return
                 }
             }
         }
     }()
+    if s.option.PingInterval > 0 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            keepAliveLoop(s.option.PingInterval, s.option.MaxMissedPings, sess.KeepAlive(), sess.Done(),
+                func() error {
+                    return common.NewPingMessage(sess.SendCh(), sess.Done(), sess.KeepAlive().Track()).Emit()
+                },
+                func() {
+                    _ = sess.CloseWithCode(common.CloseCodeError, "keepalive timeout")
+                })
+        }()
+    }
     wg.Add(1)
     go func() {
+        var (
+            err error
+            msg *common.Message
+        )
         defer func() {
             wg.Done()
-            sendCh <- nil
-            _ = conn.Close()
-            close(sendCh)
-            close(exitCh)
+            if err != nil {
+                _ = sess.CloseWithCode(common.CloseCodeError, err.Error())
+            } else {
+                _ = sess.Close("read loop exit")
+            }
         }()
         for {
             select {
-            case <-exitCh:
+            case <-sess.Done():
                 return
             default:
                 if err = s.setReadTimeout(conn); err != nil {
                     log.Println(err)
                     return
                 }
-                msg = common.NewMessage(sendCh)
-                err = msg.Decode(r)
+                msg, err = sess.ReadMessage(r)
                 if err != nil {
-                    log.Println(err)
+                    s.logConnError(sess, err)
                     return
                 }
-                err = s.handleMessage(id, msg)
+                err = s.handleMessage(sess, msg)
                 if err != nil {
-                    log.Println(err)
+                    s.logConnError(sess, err)
                     return
                 }
             }
@@ -162,76 +421,135 @@ func (s *Server) handleConn(conn net.Conn) {
     }()
     wg.Wait()
 }
-func (s *Server) handleMessage(id uint64, msg *common.Message) error {
+func (s *Server) handleMessage(sess *common.Session, msg *common.Message) error {
     if msg == nil {
         return nil
     }
     switch msg.Type {
+    case common.MessageTypeRequest, common.MessageTypeOneWay, common.MessageTypeCall:
+        if err := s.beforeHandle(sess, msg); err != nil {
+            if err == common.ErrorMessageDropped {
+                return nil
+            }
+            switch msg.Type {
+            case common.MessageTypeCall:
+                return msg.Reply(common.EncodeCallError(err))
+            case common.MessageTypeRequest:
+                return msg.ReplyError(err)
+            }
+            return nil
+        }
+    }
+    switch msg.Type {
     case common.MessageTypeRequest, common.MessageTypeOneWay:
         // on message
         s.pluginContainer.Range(func(i interface{}) {
             if p, ok := i.(common.ServerOnMessagePlugin); ok {
-                p.OnMessage(id, msg)
+                p.OnMessage(sess, msg)
             }
         })
-    case common.MessageTypeResponse:
+    case common.MessageTypeCall:
+        return s.handleCall(sess, msg)
+    case common.MessageTypeResponse, common.MessageTypeError:
         // on reply
-        s.requestManager.OnReply(msg)
+        sess.Requests().OnReply(msg)
         return nil
     case common.MessageTypeKeep:
-        return s.sendKeepAlive(id)
+        _, _, err := handleKeepAlive(msg, sess.KeepAlive())
+        return err
+    case common.MessageTypeClose:
+        return sess.HandleClose(msg)
+    case common.MessageTypeCloseAck:
+        sess.HandleCloseAck()
     default:
         return common.ErrorMessageTypeInvalid
     }
     return nil
 }
 
-func (s *Server) sendKeepAlive(id uint64) error {
-    ch := s.getSendChannel(id)
-    if ch == nil {
-        return common.ErrorConnectionInvalid
-    }
-    msg := common.NewMessage(ch)
-    msg.Type = common.MessageTypeKeep
-    msg.Emit()
-    return nil
-}
-func (s *Server) getSendChannel(id uint64) chan []byte {
-    s.mutex.Lock()
-    ch, ok := s.sessions[id]
-    s.mutex.Unlock()
-    if ok {
-        return ch
-    }
-    return nil
-}
 func (s *Server) Request(id uint64, tag uint32, data []byte, cb func(*common.Message)) (n int, err error) {
-    ch := s.getSendChannel(id)
-    if ch == nil {
+    sess := s.Session(id)
+    if sess == nil {
         return 0, common.ErrorConnectionInvalid
     }
 
-    msg := common.NewMessage(ch)
+    msg := sess.NewMessage()
     msg.Type = common.MessageTypeRequest
-    msg.RequestId = s.requestManager.NextRequestId(cb)
+    msg.RequestId = sess.Requests().NextRequestId(cb)
     msg.Payload = data
-    msg.Emit()
-
-    return 0, nil
+    if err = msg.Emit(); err != nil {
+        sess.Requests().Remove(msg.RequestId)
+    }
+    return 0, err
 }
 
 func (s *Server) Push(id uint64, tag uint32, data []byte) (n int, err error) {
-    ch := s.getSendChannel(id)
-    if ch == nil {
+    sess := s.Session(id)
+    if sess == nil {
         return 0, common.ErrorConnectionInvalid
     }
-    msg := common.NewMessage(ch)
+    msg := sess.NewMessage()
     msg.Type = common.MessageTypeOneWay
     msg.RequestId = 0
     msg.Payload = data
 
-    msg.Emit()
-    return 0, nil
+    return 0, msg.Emit()
+}
+func (s *Server) handleCall(sess *common.Session, msg *common.Message) error {
+    servicePath, serviceMethod, payload, err := common.DecodeCall(msg.Payload)
+    if err != nil {
+        return err
+    }
+    if servicePath == HealthServicePath {
+        return s.health.handle(sess, msg, serviceMethod, payload)
+    }
+    s.mutex.RLock()
+    handler, ok := s.handlers[servicePath+"/"+serviceMethod]
+    s.mutex.RUnlock()
+    if !ok {
+        return msg.Reply(common.EncodeCallError(common.ErrorServiceNotFound))
+    }
+    // 在单独的 goroutine 中处理, 不阻塞链接上的其他调用和 keepalive
+    sess.BeginCall()
+    go func() {
+        defer sess.EndCall()
+        reply, err := handler(sess, payload)
+        if err != nil {
+            _ = msg.Reply(common.EncodeCallError(err))
+            return
+        }
+        _ = msg.Reply(common.EncodeCallReply(reply))
+    }()
+    return nil
+}
+
+// 依次调用 ServerBeforeHandlePlugin, 返回第一个错误
+func (s *Server) beforeHandle(sess *common.Session, msg *common.Message) error {
+    var err error
+    s.pluginContainer.Range(func(i interface{}) {
+        if p, ok := i.(common.ServerBeforeHandlePlugin); ok && err == nil {
+            err = p.BeforeHandle(sess, msg)
+        }
+    })
+    return err
+}
+
+// 踢掉一个链接: 发送带原因的关闭消息, 对端确认后断开链接
+func (s *Server) Kick(id uint64, code uint32, reason string) error {
+    sess := s.Session(id)
+    if sess == nil {
+        return common.ErrorConnectionInvalid
+    }
+    return sess.GracefulClose(code, reason, kickFlushTimeout)
+}
+
+// 链接已经关闭时的读写错误不再输出
+func (s *Server) logConnError(sess *common.Session, err error) {
+    select {
+    case <-sess.Done():
+    default:
+        log.Println(err)
+    }
 }
 func (s *Server) setReadTimeout(conn net.Conn) error {
     if s.option.ReadTimeout == 0 {